@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"wx_channel/pkg/argv"
+	"wx_channel/pkg/download"
+)
+
+// 批量下载时筛选视频的条件，零值表示不限制
+type BatchFilter struct {
+	Since       time.Time
+	Until       time.Time
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Keyword     string
+}
+
+// 批量下载的请求，也用于 /__wx_channels_api/batch
+type BatchRequest struct {
+	// 用户名或者 ID
+	User string `json:"user"`
+	// 日期格式为 2006-01-02
+	Since       string `json:"since,omitempty"`
+	Until       string `json:"until,omitempty"`
+	MinDuration int64  `json:"min_duration,omitempty"`
+	MaxDuration int64  `json:"max_duration,omitempty"`
+	Keyword     string `json:"keyword,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+}
+
+type BatchItem struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	CreateTime int64  `json:"createtime,omitempty"`
+	Duration   int64  `json:"duration,omitempty"`
+	// dry_run queued downloaded failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	JobID  string `json:"job_id,omitempty"`
+}
+
+func (r BatchRequest) Filter() (BatchFilter, error) {
+	var f BatchFilter
+	if r.Since != "" {
+		t, err := time.ParseInLocation("2006-01-02", r.Since, time.Local)
+		if err != nil {
+			return f, fmt.Errorf("日期格式应为 2006-01-02，%v", err)
+		}
+		f.Since = t
+	}
+	if r.Until != "" {
+		t, err := time.ParseInLocation("2006-01-02", r.Until, time.Local)
+		if err != nil {
+			return f, fmt.Errorf("日期格式应为 2006-01-02，%v", err)
+		}
+		// 包含截止日期当天
+		f.Until = t.AddDate(0, 0, 1)
+	}
+	f.MinDuration = time.Duration(r.MinDuration) * time.Second
+	f.MaxDuration = time.Duration(r.MaxDuration) * time.Second
+	f.Keyword = strings.TrimSpace(r.Keyword)
+	return f, nil
+}
+
+func (f BatchFilter) Match(video VideoInfo) bool {
+	created := time.Unix(video.CreateTime, 0)
+	if !f.Since.IsZero() && (video.CreateTime == 0 || created.Before(f.Since)) {
+		return false
+	}
+	if !f.Until.IsZero() && (video.CreateTime == 0 || !created.Before(f.Until)) {
+		return false
+	}
+	duration := time.Duration(video.Duration) * time.Millisecond
+	if f.MinDuration > 0 && duration < f.MinDuration {
+		return false
+	}
+	if f.MaxDuration > 0 && (video.Duration == 0 || duration > f.MaxDuration) {
+		return false
+	}
+	if f.Keyword != "" && !strings.Contains(strings.ToLower(video.Title), strings.ToLower(f.Keyword)) {
+		return false
+	}
+	return true
+}
+
+// 根据用户名或 ID 查找用户信息，内存中没有时从 profiles 目录读取，返回的是副本
+func findProfile(user string) (*UserProfile, error) {
+	if user == "" {
+		return nil, errors.New("缺少用户名或 ID")
+	}
+	if profile := findProfileInMemory(user); profile != nil {
+		return profile, nil
+	}
+	files, _ := filepath.Glob(filepath.Join(profiles_dir, "*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var profile UserProfile
+		if err := json.Unmarshal(data, &profile); err != nil {
+			continue
+		}
+		if profile.Username == user || profile.ID == user {
+			return &profile, nil
+		}
+	}
+	return nil, fmt.Errorf("没有找到用户 %s", user)
+}
+
+func findProfileInMemory(user string) *UserProfile {
+	profiles_mu.Lock()
+	defer profiles_mu.Unlock()
+	if profile, ok := userProfiles[user]; ok {
+		return profile.clone()
+	}
+	for _, profile := range userProfiles {
+		if profile.ID == user {
+			return profile.clone()
+		}
+	}
+	return nil
+}
+
+// 将用户符合条件的视频加入下载队列
+func batchDownload(req BatchRequest) ([]BatchItem, error) {
+	filter, err := req.Filter()
+	if err != nil {
+		return nil, err
+	}
+	profile, err := findProfile(req.User)
+	if err != nil {
+		return nil, err
+	}
+	var items []BatchItem
+	for _, video := range profile.Videos {
+		if video.URL == "" || !filter.Match(video) {
+			continue
+		}
+		item := BatchItem{
+			ID:         video.ID,
+			Title:      video.Title,
+			CreateTime: video.CreateTime,
+			Duration:   video.Duration,
+			Status:     "dry_run",
+		}
+		if !req.DryRun {
+			media := videoToMedia(video)
+			media.Nickname = profile.Nickname
+			job, err := downloader.Add(media, req.Force)
+			switch {
+			case err == download.ErrDownloaded:
+				item.Status = "downloaded"
+			case err != nil:
+				item.Status = "failed"
+				item.Error = err.Error()
+			default:
+				item.Status = "queued"
+				item.JobID = job.ID
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// batch <用户名或ID> [--since] [--until] [--min-duration] [--max-duration] [--keyword] [--dry-run] [--force]
+func runBatchCommand(rest []string, args argv.Map) int {
+	if len(rest) == 0 {
+		fmt.Printf("请指定用户名或 ID\n")
+		return 1
+	}
+	min_duration, _ := strconv.ParseInt(argv.ArgsValue(args, "0", "min-duration"), 10, 64)
+	max_duration, _ := strconv.ParseInt(argv.ArgsValue(args, "0", "max-duration"), 10, 64)
+	_, dry_run := args["dry-run"]
+	_, force := args["force"]
+	items, err := batchDownload(BatchRequest{
+		User:        rest[0],
+		Since:       argv.ArgsValue(args, "", "since"),
+		Until:       argv.ArgsValue(args, "", "until"),
+		MinDuration: min_duration,
+		MaxDuration: max_duration,
+		Keyword:     argv.ArgsValue(args, "", "keyword"),
+		DryRun:      dry_run,
+		Force:       force,
+	})
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	var ids []string
+	for _, item := range items {
+		created := ""
+		if item.CreateTime != 0 {
+			created = time.Unix(item.CreateTime, 0).Format("2006-01-02")
+		}
+		fmt.Printf("%-10s %s %6ds  %s %s\n", item.Status, created, item.Duration/1000, item.Title, item.Error)
+		if item.JobID != "" {
+			ids = append(ids, item.JobID)
+		}
+	}
+	fmt.Printf("共 %d 个视频，新加入下载队列 %d 个\n", len(items), len(ids))
+	if len(ids) > 0 {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signalChan
+			// 保存未完成下载的进度，下次可以继续下载
+			downloader.Close()
+		}()
+		downloader.Start(3)
+		downloader.Wait(ids)
+		downloader.Close()
+	}
+	return 0
+}
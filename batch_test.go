@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wx_channel/pkg/download"
+)
+
+// 使用临时目录中的用户信息和下载队列，结束后恢复
+func useTestProfiles(t *testing.T) string {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	prev_downloader, prev_dir, prev_profiles := downloader, profiles_dir, userProfiles
+	t.Cleanup(func() {
+		downloader, profiles_dir, userProfiles = prev_downloader, prev_dir, prev_profiles
+	})
+	dir := t.TempDir()
+	var err error
+	if downloader, err = download.NewManager(filepath.Join(dir, "downloads"), 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	profiles_dir = filepath.Join(dir, "profiles")
+	if err := os.MkdirAll(profiles_dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	userProfiles = make(map[string]*UserProfile)
+	return dir
+}
+
+// 记录为已经下载过
+func markDownloaded(t *testing.T, video VideoInfo) {
+	t.Helper()
+	path := filepath.Join(downloader.Dir, video.ID+".mp4")
+	if err := os.WriteFile(path, []byte(video.ID), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.History.Add(videoToMedia(video), path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchFilter(t *testing.T) {
+	day := func(s string) int64 {
+		d, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Unix()
+	}
+	for _, tt := range []struct {
+		name  string
+		req   BatchRequest
+		video VideoInfo
+		want  bool
+	}{
+		{"no filter", BatchRequest{}, VideoInfo{}, true},
+		{"since", BatchRequest{Since: "2024-05-01"}, VideoInfo{CreateTime: day("2024-05-01 00:00")}, true},
+		{"before since", BatchRequest{Since: "2024-05-01"}, VideoInfo{CreateTime: day("2024-04-30 23:59")}, false},
+		{"since without time", BatchRequest{Since: "2024-05-01"}, VideoInfo{}, false},
+		// 包含截止日期当天
+		{"until", BatchRequest{Until: "2024-05-01"}, VideoInfo{CreateTime: day("2024-05-01 23:59")}, true},
+		{"after until", BatchRequest{Until: "2024-05-01"}, VideoInfo{CreateTime: day("2024-05-02 00:00")}, false},
+		{"until without time", BatchRequest{Until: "2024-05-01"}, VideoInfo{}, false},
+		// 时长的单位是毫秒，条件的单位是秒
+		{"min duration", BatchRequest{MinDuration: 60}, VideoInfo{Duration: 60000}, true},
+		{"too short", BatchRequest{MinDuration: 60}, VideoInfo{Duration: 59999}, false},
+		{"max duration", BatchRequest{MaxDuration: 60}, VideoInfo{Duration: 60000}, true},
+		{"too long", BatchRequest{MaxDuration: 60}, VideoInfo{Duration: 60001}, false},
+		{"max duration unknown", BatchRequest{MaxDuration: 60}, VideoInfo{}, false},
+		{"keyword", BatchRequest{Keyword: " Vlog "}, VideoInfo{Title: "周末 vlog 合集"}, true},
+		{"no keyword", BatchRequest{Keyword: "vlog"}, VideoInfo{Title: "周末"}, false},
+		{"all", BatchRequest{Since: "2024-05-01", Until: "2024-05-31", MinDuration: 10, MaxDuration: 60, Keyword: "vlog"},
+			VideoInfo{Title: "vlog", CreateTime: day("2024-05-15 12:00"), Duration: 30000}, true},
+	} {
+		f, err := tt.req.Filter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(tt.video); got != tt.want {
+			t.Errorf("%s: Match = %v，应为 %v", tt.name, got, tt.want)
+		}
+	}
+	for _, req := range []BatchRequest{{Since: "2024/05/01"}, {Until: "20240501"}} {
+		if _, err := req.Filter(); err == nil {
+			t.Errorf("%+v 应该返回错误", req)
+		}
+	}
+}
+
+func TestFindProfile(t *testing.T) {
+	useTestProfiles(t)
+	userProfiles["v2_memory@finder"] = &UserProfile{Username: "v2_memory@finder", ID: "memory_id", Nickname: "内存", Videos: []VideoInfo{{ID: "1"}}}
+	data, _ := json.Marshal(UserProfile{Username: "v2_disk@finder", ID: "disk_id", Nickname: "磁盘"})
+	if err := os.WriteFile(filepath.Join(profiles_dir, "v2_disk@finder.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(profiles_dir, "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user string
+		want string
+	}{
+		{"v2_memory@finder", "内存"},
+		{"memory_id", "内存"},
+		{"v2_disk@finder", "磁盘"},
+		{"disk_id", "磁盘"},
+		{"v2_missing@finder", ""},
+		{"", ""},
+	} {
+		profile, err := findProfile(tt.user)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q 应该返回错误", tt.user)
+			}
+			continue
+		}
+		if err != nil || profile.Nickname != tt.want {
+			t.Errorf("findProfile(%q) = %+v, %v", tt.user, profile, err)
+		}
+	}
+	// 返回的是副本
+	profile, _ := findProfile("v2_memory@finder")
+	profile.Videos[0].ID = "2"
+	if userProfiles["v2_memory@finder"].Videos[0].ID != "1" {
+		t.Fatal("修改返回的用户信息影响了内存中的用户信息")
+	}
+}
+
+func TestBatchDownload(t *testing.T) {
+	useTestProfiles(t)
+	videos := []VideoInfo{
+		{ID: "1", Title: "vlog 1", URL: "https://finder.video.qq.com/stodownload?encfilekey=1"},
+		{ID: "2", Title: "vlog 2", URL: "https://finder.video.qq.com/stodownload?encfilekey=2"},
+		{ID: "3", Title: "other", URL: "https://finder.video.qq.com/stodownload?encfilekey=3"},
+		{ID: "4", Title: "vlog 没有地址"},
+	}
+	userProfiles["v2_batch@finder"] = &UserProfile{Username: "v2_batch@finder", Nickname: "批量", Videos: videos}
+	markDownloaded(t, videos[0])
+
+	items, err := batchDownload(BatchRequest{User: "v2_batch@finder", Keyword: "vlog", DryRun: true})
+	if err != nil || len(items) != 2 || items[0].Status != "dry_run" || items[1].Status != "dry_run" {
+		t.Fatalf("dry_run %+v %v", items, err)
+	}
+	if jobs := downloader.Queue.Jobs(); len(jobs) != 0 {
+		t.Fatalf("dry_run 加入了下载队列 %+v", jobs)
+	}
+
+	items, err = batchDownload(BatchRequest{User: "v2_batch@finder", Keyword: "vlog"})
+	if err != nil || len(items) != 2 {
+		t.Fatalf("%+v %v", items, err)
+	}
+	if items[0].Status != "downloaded" || items[1].Status != "queued" || items[1].JobID == "" {
+		t.Fatalf("items = %+v", items)
+	}
+	if jobs := downloader.Queue.Jobs(); len(jobs) != 1 || jobs[0].Media.Nickname != "批量" {
+		t.Fatalf("jobs = %+v", jobs)
+	}
+	// 已经在队列中
+	items, _ = batchDownload(BatchRequest{User: "v2_batch@finder", Keyword: "vlog 2"})
+	if len(items) != 1 || items[0].Status != "failed" || items[0].Error != download.ErrQueued.Error() {
+		t.Fatalf("items = %+v", items)
+	}
+	items, _ = batchDownload(BatchRequest{User: "v2_batch@finder", Keyword: "vlog 1", Force: true})
+	if len(items) != 1 || items[0].Status != "queued" {
+		t.Fatalf("force 时 items = %+v", items)
+	}
+
+	if _, err := batchDownload(BatchRequest{User: "v2_batch@finder", Since: "bad"}); err == nil {
+		t.Fatal("日期格式错误时应返回错误")
+	}
+	if _, err := batchDownload(BatchRequest{User: "v2_missing@finder"}); err == nil {
+		t.Fatal("用户不存在时应返回错误")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"wx_channel/pkg/argv"
+	"wx_channel/pkg/certificate"
+	"wx_channel/pkg/download"
+	"wx_channel/pkg/proxy"
+	"wx_channel/pkg/replay"
+	"wx_channel/pkg/rewrite"
+)
+
+// 子命令，如 wx_video_download history prune
+func commandFromArgs(osArgs []string) (string, []string) {
+	if len(osArgs) < 2 || strings.HasPrefix(osArgs[1], "-") {
+		return "", nil
+	}
+	var rest []string
+	for _, a := range osArgs[2:] {
+		if strings.HasPrefix(a, "-") {
+			break
+		}
+		rest = append(rest, a)
+	}
+	return osArgs[1], rest
+}
+
+// 执行子命令，返回进程退出码
+func runCommand(name string, rest []string, args argv.Map) int {
+	switch name {
+	case "history":
+		return runHistoryCommand(rest, args)
+	case "batch":
+		return runBatchCommand(rest, args)
+	case "cert":
+		return runCertCommand(rest, args)
+	case "status":
+		return runStatusCommand(args)
+	case "rules":
+		return runRulesCommand(rest, args)
+	case "replay":
+		return runReplayCommand(rest, args)
+	}
+	fmt.Printf("未知的命令 %s，使用 --help 查看帮助\n", name)
+	return 1
+}
+
+// history [list]            列出已下载的视频
+// history prune [--before]  删除文件已不存在或早于指定日期的记录
+func runHistoryCommand(rest []string, args argv.Map) int {
+	history, err := download.OpenHistory(filepath.Join(args["output"], "history.json"))
+	if err != nil {
+		fmt.Printf("\nERROR 读取下载记录失败，%v\n", err.Error())
+		return 1
+	}
+	action := "list"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+	switch action {
+	case "list":
+		records := history.List()
+		for _, r := range records {
+			fmt.Printf("%s  %-20s %-8s %10d  %s\n", r.Time.Format("2006-01-02 15:04:05"), r.ID, r.Spec, r.Size, r.Path)
+		}
+		fmt.Printf("共 %d 条下载记录\n", len(records))
+		return 0
+	case "prune":
+		var before time.Time
+		if v := argv.ArgsValue(args, "", "before"); v != "" {
+			t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+			if err != nil {
+				fmt.Printf("\nERROR 日期格式应为 2006-01-02，%v\n", err.Error())
+				return 1
+			}
+			before = t
+		}
+		n, err := history.Prune(before)
+		if err != nil {
+			fmt.Printf("\nERROR 保存下载记录失败，%v\n", err.Error())
+			return 1
+		}
+		fmt.Printf("已删除 %d 条下载记录\n", n)
+		return 0
+	}
+	fmt.Printf("未知的操作 %s，可用的操作有 list prune\n", action)
+	return 1
+}
+
+// status  查看代理配置和根证书安装情况
+func runStatusCommand(args argv.Map) int {
+	fmt.Printf("代理引擎  %s\n", args["engine"])
+	fmt.Printf("端口      %s\n", args["port"])
+	if upstream != nil {
+		fmt.Printf("上游代理  %v\n", upstream)
+		fmt.Printf("直接连接  %s\n", strings.Join(upstream.Bypass, ", "))
+	} else {
+		fmt.Printf("上游代理  无\n")
+	}
+	fmt.Printf("解密域名  %v\n", intercept)
+	if !intercept.All() {
+		fmt.Printf("          其余 HTTPS 连接直接转发，不解密\n")
+	}
+	if rules.Path() == "" {
+		fmt.Printf("替换规则  内置，共 %d 条\n", len(rules.Rules()))
+	} else {
+		fmt.Printf("替换规则  %s，共 %d 条\n", rules.Path(), len(rules.Rules()))
+	}
+	fmt.Printf("缓存版本  %s\n", cacheVersion())
+	for _, b := range health.Report().Bundles {
+		state := "正常"
+		if len(b.Missing) > 0 {
+			state = "规则失效 " + strings.Join(b.Missing, ", ")
+		}
+		fmt.Printf("脚本      %s  %.16s  %s  %s\n", b.Name, b.SHA256, b.FirstSeen.Format("2006-01-02 15:04"), state)
+	}
+	dir, err := certificate.DefaultCADir()
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	ca, err := certificate.LoadCA(dir)
+	if err != nil {
+		fmt.Printf("根证书    未生成\n")
+		return 0
+	}
+	found, err := certificate.FindCertificate(ca.Fingerprint())
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	if len(found) == 0 {
+		fmt.Printf("根证书    %s 未安装\n", ca.Name())
+	} else {
+		fmt.Printf("根证书    %s 已安装\n", ca.Name())
+	}
+	return 0
+}
+
+// rules [list]              列出当前使用的替换规则
+// rules export [--file]     导出内置的替换规则，修改后使用 --rules 指定
+func runRulesCommand(rest []string, args argv.Map) int {
+	action := "list"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+	switch action {
+	case "list":
+		if rules.Path() == "" {
+			fmt.Printf("使用内置的替换规则\n")
+		} else {
+			fmt.Printf("使用替换规则文件 %s\n", rules.Path())
+		}
+		for _, r := range rules.Rules() {
+			required := ""
+			if r.Required {
+				required = "必须匹配"
+			}
+			fmt.Printf("  %-20s %-24s %-24s %s\n", r.Name, r.Host, r.ContentType, required)
+		}
+		return 0
+	case "export":
+		file := argv.ArgsValue(args, "wx_channels_rules.json", "file")
+		if err := os.WriteFile(file, rewrite.DefaultRules, 0644); err != nil {
+			fmt.Printf("\nERROR 导出替换规则失败，%v\n", err.Error())
+			return 1
+		}
+		fmt.Printf("已导出内置的替换规则到 %s\n", file)
+		return 0
+	}
+	fmt.Printf("未知的操作 %s，可用的操作有 list export\n", action)
+	return 1
+}
+
+// replay <file.har|dir>...  使用录制的请求代替视频号服务器，离线调试替换规则和信息提取
+// 目录中可以是 .har 文件，或者旧版本保存的 html/ js/ 目录
+func runReplayCommand(rest []string, args argv.Map) int {
+	if len(rest) == 0 {
+		fmt.Printf("请指定 HAR 文件，或者包含 .har 文件、html/ js/ 目录的文件夹\n")
+		return 1
+	}
+	store := replay.NewStore()
+	for _, path := range rest {
+		if err := store.Load(path); err != nil {
+			fmt.Printf("\nERROR 读取录制内容失败，%v\n", err.Error())
+			return 1
+		}
+	}
+	if store.Len() == 0 {
+		fmt.Printf("没有可以回放的请求\n")
+		return 1
+	}
+	dir, err := certificate.DefaultCADir()
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	ca, _, err := certificate.LoadOrCreateCA(dir)
+	if err != nil {
+		fmt.Printf("\nERROR 加载根证书失败，%v\n", err.Error())
+		return 1
+	}
+	tmp_dir, err := isolateReplay()
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	defer os.RemoveAll(tmp_dir)
+	replay_engine, err := startReplay(store, fmt.Sprintf("127.0.0.1:%d", port), ca)
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	fmt.Printf("回放时的脚本指纹、用户信息和下载队列保存在 %s，退出后删除\n", tmp_dir)
+	fmt.Printf("正在回放 %d 个请求，代理地址 %s，按 Ctrl+C 退出\n", store.Len(), replay_engine.ListenAddr())
+	signal_chan := make(chan os.Signal, 1)
+	signal.Notify(signal_chan, syscall.SIGINT, syscall.SIGTERM)
+	<-signal_chan
+	replay_engine.Stop()
+	if missed := store.Missed(); len(missed) > 0 {
+		fmt.Printf("\n以下 %d 个请求没有录制\n", len(missed))
+		for _, m := range missed {
+			fmt.Printf("  %s\n", m)
+		}
+	}
+	return 0
+}
+
+// 回放的内容不能写入正常运行时的记录，否则会混入脚本指纹的历史，并误报视频号前端已更新
+// 脚本指纹、用户信息和下载队列改为保存在临时目录中，返回该目录
+func isolateReplay() (string, error) {
+	dir, err := os.MkdirTemp("", "wx_channels_replay_")
+	if err != nil {
+		return "", fmt.Errorf("创建临时目录失败，%v", err)
+	}
+	h, err := rewrite.OpenHealth(filepath.Join(dir, "bundles.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	manager, err := download.NewManager(filepath.Join(dir, "downloads"), downloader.Connections, 1)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	manager.Quality = downloader.Quality
+	manager.Template = downloader.Template
+	health = h
+	downloader = manager
+	profiles_dir = filepath.Join(dir, "profiles")
+	return dir, nil
+}
+
+// 启动代理，所有请求都由录制的内容返回，经过和正常运行时相同的 HttpCallback
+func startReplay(store *replay.Store, addr string, ca *certificate.CA) (*proxy.MITMEngine, error) {
+	replay_engine, err := proxy.NewMITMEngine(addr, ca)
+	if err != nil {
+		return nil, err
+	}
+	replay_engine.Transport = store
+	api_transport = store
+	replay_engine.OnRequest(HttpCallback)
+	replay_engine.OnResponse(HttpCallback)
+	if err := replay_engine.Start(); err != nil {
+		return nil, err
+	}
+	return replay_engine, nil
+}
+
+// cert status                                   查看根证书和安装情况
+// cert uninstall [--fingerprint] [--purge]      从系统证书库中删除根证书
+// cert export [--format pem|der|p12] [--file] [--password] [--include-key]
+func runCertCommand(rest []string, args argv.Map) int {
+	action := "status"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+	dir, err := certificate.DefaultCADir()
+	if err != nil {
+		fmt.Printf("\nERROR %v\n", err.Error())
+		return 1
+	}
+	ca, err := certificate.LoadCA(dir)
+	if err != nil && !(action == "uninstall" && os.IsNotExist(err)) {
+		if os.IsNotExist(err) {
+			fmt.Printf("还没有生成根证书，首次运行时会自动生成\n")
+		} else {
+			fmt.Printf("\nERROR 读取根证书失败，%v\n", err.Error())
+		}
+		return 1
+	}
+	switch action {
+	case "status":
+		fmt.Printf("名称      %s\n", ca.Name())
+		fmt.Printf("SHA-256   %s\n", ca.Fingerprint())
+		fmt.Printf("有效期至  %s\n", ca.Cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("文件      %s\n", ca.CertPath())
+		found, err := certificate.FindCertificate(ca.Fingerprint())
+		if err != nil {
+			fmt.Printf("\nERROR %v\n", err.Error())
+			return 1
+		}
+		if len(found) == 0 {
+			fmt.Printf("状态      未安装\n")
+		} else {
+			fmt.Printf("状态      已安装\n")
+			for _, item := range found {
+				fmt.Printf("  %s  %s\n", item.Store, item.Name)
+			}
+		}
+		// 旧版本安装的 SunnyNet 根证书需要手动删除
+		legacy, _ := certificate.FindCertificate(certificate.LegacySunnyFingerprint)
+		if len(legacy) > 0 {
+			fmt.Printf("\nWARNING 系统中仍然信任旧版本安装的 SunnyNet 根证书，它的私钥是公开的，任何人都可以用它伪造网站证书\n")
+			for _, item := range legacy {
+				fmt.Printf("  %s  %s\n", item.Store, item.Name)
+			}
+			fmt.Printf("请使用 wx_video_download cert uninstall --fingerprint %s 删除\n", certificate.LegacySunnyFingerprint)
+		}
+		return 0
+	case "uninstall":
+		fingerprint := argv.ArgsValue(args, "", "fingerprint")
+		if fingerprint == "" {
+			if ca == nil {
+				fmt.Printf("还没有生成根证书，请使用 --fingerprint 指定要删除的证书\n")
+				return 1
+			}
+			fingerprint = ca.Fingerprint()
+		}
+		removed, err := certificate.UninstallCertificate(fingerprint)
+		for _, item := range removed {
+			fmt.Printf("已删除 %s  %s\n", item.Store, item.Name)
+		}
+		if err != nil {
+			fmt.Printf("\nERROR %v\n", err.Error())
+			return 1
+		}
+		if len(removed) == 0 {
+			fmt.Printf("系统中没有找到该证书\n")
+		}
+		if _, purge := args["purge"]; purge && ca != nil {
+			if err := ca.Remove(); err != nil {
+				fmt.Printf("\nERROR 删除根证书文件失败，%v\n", err.Error())
+				return 1
+			}
+			fmt.Printf("已删除根证书文件，下次运行时会重新生成\n")
+		}
+		return 0
+	case "export":
+		format := argv.ArgsValue(args, "pem", "format")
+		// 默认只导出根证书，私钥只在明确指定时导出
+		_, include_key := args["include-key"]
+		if include_key && format != "p12" {
+			fmt.Printf("只有 p12 格式可以包含私钥\n")
+			return 1
+		}
+		var data []byte
+		ext := ""
+		switch format {
+		case "pem":
+			data, ext = ca.CertPEM, ".pem"
+		case "der":
+			data, ext = ca.Cert.Raw, ".cer"
+		case "p12":
+			data, err = ca.PKCS12(argv.ArgsValue(args, "", "password"), include_key)
+			if err != nil {
+				fmt.Printf("\nERROR 生成 p12 文件失败，%v\n", err.Error())
+				return 1
+			}
+			ext = ".p12"
+		default:
+			fmt.Printf("未知的格式 %s，可用的格式有 pem der p12\n", format)
+			return 1
+		}
+		file := argv.ArgsValue(args, "wx_channels_download_ca"+ext, "file")
+		perm := os.FileMode(0644)
+		if include_key {
+			perm = 0600
+		}
+		if err := os.WriteFile(file, data, perm); err != nil {
+			fmt.Printf("\nERROR 保存证书失败，%v\n", err.Error())
+			return 1
+		}
+		fmt.Printf("已导出到 %s\n", file)
+		if include_key {
+			fmt.Printf("注意 p12 文件中包含根证书私钥，持有私钥可以伪造任意网站的证书，不要复制到其他设备或分享给他人\n")
+		}
+		return 0
+	}
+	fmt.Printf("未知的操作 %s，可用的操作有 status uninstall export\n", action)
+	return 1
+}
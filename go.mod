@@ -5,22 +5,22 @@ go 1.21
 toolchain go1.22.4
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/fatih/color v1.15.0
+	github.com/klauspost/compress v1.17.11
 	github.com/qtgolang/SunnyNet v1.1.6
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/Trisia/gosysproxy v1.1.0 // indirect
-	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/shirou/gopsutil v3.21.11+incompatible // indirect
 	github.com/tklauser/go-sysconf v0.3.14 // indirect
 	github.com/tklauser/numcpus v0.8.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
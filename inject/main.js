@@ -41,6 +41,7 @@ function __wx_log(msg) {
     method: "POST",
     headers: {
       "Content-Type": "application/json",
+      "X-Wx-Channels-Token": window.__wx_channels_api_token__,
     },
     body: JSON.stringify(msg),
   });
@@ -210,6 +211,44 @@ async function __wx_channels_download4(profile, filename) {
   const result = new Blob([array], { type: "video/mp4" });
   saveAs(result, filename + ".mp4");
 }
+/** 交给本地服务下载并解密 */
+async function __wx_channels_download_by_server(profile, filename, force) {
+  console.log("__wx_channels_download_by_server");
+  const response = await fetch("/__wx_channels_api/download", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-Wx-Channels-Token": window.__wx_channels_api_token__,
+    },
+    body: JSON.stringify({
+      id: profile.id,
+      nonce_id: profile.nonce_id,
+      title: profile.title,
+      url: profile.url,
+      key: profile.key,
+      size: profile.size,
+      format: profile.format,
+      specs: profile.spec,
+      nickname: profile.nickname,
+      createtime: profile.createtime,
+      force: !!force,
+    }),
+  });
+  const result = await response.json();
+  if (result.downloaded) {
+    if (confirm("该视频已经下载过，是否重新下载？")) {
+      __wx_channels_download_by_server(profile, filename, true);
+    }
+    return;
+  }
+  if (result.errMsg) {
+    alert(result.errMsg);
+    return;
+  }
+  if (window.__wx_channels_tip__ && window.__wx_channels_tip__.toast) {
+    window.__wx_channels_tip__.toast("已添加到下载", 1e3);
+  }
+}
 function __wx_load_script(src) {
   return new Promise((resolve, reject) => {
     const script = document.createElement("script");
@@ -256,6 +295,7 @@ async function __wx_channels_handle_click_download__(spec) {
   };
   if (spec) {
     _profile.url = profile.url + "&X-snsvideoflag=" + spec.fileFormat;
+    _profile.format = spec.fileFormat;
     filename = filename + "_" + spec.fileFormat;
   }
   // console.log("__wx_channels_handle_click_download__", url);
@@ -269,6 +309,10 @@ ${_profile.key || ""}`,
     __wx_channels_download3(_profile, filename);
     return;
   }
+  if (window.__wx_channels_server_download__) {
+    __wx_channels_download_by_server(_profile, filename);
+    return;
+  }
   if (!_profile.key) {
     __wx_channels_download2(_profile, filename);
     return;
@@ -355,6 +399,8 @@ async function __wx_channels_handle_download_cover() {
   }
 }
 var __wx_channels_tip__ = {};
+/** 视频由本地服务下载，不再在页面中下载 */
+var __wx_channels_server_download__ = true;
 var __wx_channels_store__ = {
   profile: null,
   profiles: [],
@@ -369,8 +415,11 @@ __wx_channels_video_download_btn__.onclick = () => {
   if (!window.__wx_channels_store__.profile) {
     return;
   }
+  // 由本地服务下载时按配置的规则选择清晰度
   __wx_channels_handle_click_download__(
-    window.__wx_channels_store__.profile.spec[0]
+    window.__wx_channels_server_download__
+      ? undefined
+      : window.__wx_channels_store__.profile.spec[0]
   );
 };
 var count = 0;
@@ -378,6 +427,7 @@ fetch("/__wx_channels_api/tip", {
   method: "POST",
   headers: {
     "Content-Type": "application/json",
+    "X-Wx-Channels-Token": window.__wx_channels_api_token__,
   },
   body: JSON.stringify({
     msg: "等待注入下载按钮",
@@ -398,6 +448,7 @@ var __timer = setInterval(() => {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          "X-Wx-Channels-Token": window.__wx_channels_api_token__,
         },
         body: JSON.stringify({
           msg: "没有找到操作栏，注入下载按钮失败\n请在「更多」菜单中下载",
@@ -414,6 +465,7 @@ var __timer = setInterval(() => {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-Wx-Channels-Token": window.__wx_channels_api_token__,
       },
       body: JSON.stringify({ msg: "注入下载按钮成功1!" }),
     });
@@ -424,6 +476,7 @@ var __timer = setInterval(() => {
     method: "POST",
     headers: {
       "Content-Type": "application/json",
+      "X-Wx-Channels-Token": window.__wx_channels_api_token__,
     },
     body: JSON.stringify({ msg: "注入下载按钮成功2!" }),
   });
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeAPI(t *testing.T) {
+	const page = "https://channels.weixin.qq.com/web/pages/feed"
+	for _, tt := range []struct {
+		name    string
+		method  string
+		token   string
+		origin  string
+		referer string
+		err     string
+	}{
+		{"missing token", "POST", "", "https://channels.weixin.qq.com", "", api_token_header},
+		{"wrong token", "POST", "wrong", "https://channels.weixin.qq.com", "", api_token_header},
+		{"token prefix", "POST", api_token[:len(api_token)-1], "https://channels.weixin.qq.com", "", api_token_header},
+		{"foreign origin", "POST", api_token, "https://evil.example.com", "", "不是视频号页面"},
+		{"lookalike origin", "POST", api_token, "https://channels.weixin.qq.com.evil.example.com", "", "不是视频号页面"},
+		{"null origin", "POST", api_token, "null", page, "不是视频号页面"},
+		// 只有 GET 请求可以使用 Referer
+		{"post with referer", "POST", api_token, "", page, "不是视频号页面"},
+		{"post without origin", "POST", api_token, "", "", "不是视频号页面"},
+		{"get with referer", "GET", api_token, "", page, ""},
+		{"get with foreign referer", "GET", api_token, "", "https://evil.example.com/", "不是视频号页面"},
+		{"get without origin", "GET", api_token, "", "", "不是视频号页面"},
+		{"get foreign origin", "GET", api_token, "https://evil.example.com", page, "不是视频号页面"},
+		{"post", "POST", api_token, "https://channels.weixin.qq.com", "", ""},
+		{"get", "GET", api_token, "https://channels.weixin.qq.com", "", ""},
+	} {
+		req, err := http.NewRequest(tt.method, "https://channels.weixin.qq.com/__wx_channels_api/download", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set(api_token_header, tt.token)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		err = authorizeAPI(req)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v，应包含 %s", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package certificate
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+	// 根证书名称的前缀，后面加上随机字符，每次安装都不相同
+	caNamePrefix = "WxChannelsDownload CA"
+	caValidYears = 10
+)
+
+// 本机生成的根证书，用于给代理拦截的站点签发证书
+type CA struct {
+	Cert    *x509.Certificate
+	Key     *rsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+	// 证书和私钥所在的目录
+	Dir string
+}
+
+// 保存根证书的默认目录
+func DefaultCADir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("获取配置目录失败，%v", err)
+	}
+	return filepath.Join(dir, "wx_channels_download"), nil
+}
+
+// 读取目录中的根证书，不存在时生成新的根证书，created 表示是否是新生成的
+func LoadOrCreateCA(dir string) (ca *CA, created bool, err error) {
+	ca, err = LoadCA(dir)
+	if err == nil {
+		return ca, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	ca, err = createCA(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	return ca, true, nil
+}
+
+func LoadCA(dir string) (*CA, error) {
+	cert_pem, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, err
+	}
+	key_pem, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(cert_pem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("根证书 %s 格式错误", filepath.Join(dir, caCertFile))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析根证书失败，%v", err)
+	}
+	block, _ = pem.Decode(key_pem)
+	if block == nil {
+		return nil, fmt.Errorf("根证书私钥 %s 格式错误", filepath.Join(dir, caKeyFile))
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("解析根证书私钥失败，%v", err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("根证书和私钥不匹配")
+	}
+	return &CA{Cert: cert, Key: key, CertPEM: cert_pem, KeyPEM: key_pem, Dir: dir}, nil
+}
+
+func createCA(dir string) (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("生成根证书私钥失败，%v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("生成根证书失败，%v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("生成根证书失败，%v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   caNamePrefix + " " + strings.ToUpper(hex.EncodeToString(suffix)),
+			Organization: []string{"wx_channels_download"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(caValidYears, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("生成根证书失败，%v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("生成根证书失败，%v", err)
+	}
+	ca := &CA{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		Dir:     dir,
+	}
+	// 私钥只允许当前用户读取
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建证书目录失败，%v", err)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建证书目录失败，%v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, caKeyFile), ca.KeyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("保存根证书私钥失败，%v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, caCertFile), ca.CertPEM, 0644); err != nil {
+		return nil, fmt.Errorf("保存根证书失败，%v", err)
+	}
+	return ca, nil
+}
+
+func writeFileAtomic(file_path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file_path), filepath.Base(file_path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file_path)
+}
+
+// 根证书名称，每次安装都不相同
+func (ca *CA) Name() string {
+	return ca.Cert.Subject.CommonName
+}
+
+// 根证书文件路径
+func (ca *CA) CertPath() string {
+	return filepath.Join(ca.Dir, caCertFile)
+}
+
+// DER 格式证书的 SHA-256 指纹
+func (ca *CA) Fingerprint() string {
+	sum := sha256.Sum256(ca.Cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// 删除保存的根证书和私钥，下次运行时会重新生成
+func (ca *CA) Remove() error {
+	for _, name := range []string{caKeyFile, caCertFile} {
+		if err := os.Remove(filepath.Join(ca.Dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,13 +1,13 @@
 package certificate
 
 import (
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
-	"regexp"
 	"runtime"
-	"strings"
 )
 
 type Subject struct {
@@ -20,133 +20,152 @@ type Subject struct {
 }
 type Certificate struct {
 	Thumbprint string
-	Subject    Subject
+	// DER 格式证书的 SHA-256 指纹，大写且没有分隔符
+	SHA256  string
+	Subject Subject
+	// DER 格式的证书
+	Raw []byte
+}
+
+// 证书库中找到的证书
+type Installed struct {
+	// 证书库，如 Windows 的 LocalMachine\Root、Linux 的证书目录或 NSS 数据库目录
+	Store string
+	// 证书在证书库中的名称或文件路径
+	Name string
+	Certificate
 }
 
 func fetchCertificatesInWindows() ([]Certificate, error) {
-	// 获取指定 store 所有证书
-	cmd := fmt.Sprintf("Get-ChildItem Cert:\\LocalMachine\\Root")
-	ps := exec.Command("powershell.exe", "-Command", cmd)
-	output, err2 := ps.CombinedOutput()
-	if err2 != nil {
-		return nil, errors.New(fmt.Sprintf("获取证书时发生错误，%v\n", err2.Error()))
-	}
-	var certificates []Certificate
-	lines := strings.Split(string(output), "\n")
-	// 跳过前两行（列名）
-	for i := 2; i < len(lines)-1; i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, " ")
-		if len(parts) >= 2 {
-			subject := Subject{}
-			for _, part := range parts[1:] {
-				part = strings.Replace(part, ",", "", 1)
-				kv := strings.Split(part, "=")
-				if len(kv) == 2 {
-					key := strings.TrimSpace(kv[0])
-					value := strings.TrimSpace(kv[1])
-					switch key {
-					case "CN":
-						subject.CN = value
-					case "OU":
-						subject.OU = value
-					case "O":
-						subject.O = value
-					case "L":
-						subject.L = value
-					case "S":
-						subject.S = value
-					case "C":
-						subject.C = value
-					}
-				}
-			}
-			certificates = append(certificates, Certificate{
-				Thumbprint: parts[0],
-				Subject:    subject,
-			})
-		}
+	// 输出 LocalMachine\\Root 中每个证书的 DER 数据，每行一个 base64
+	output, err := runner.Run("powershell.exe", "-Command", "Get-ChildItem Cert:\\LocalMachine\\Root | ForEach-Object { [Convert]::ToBase64String($_.RawData) }")
+	if err != nil {
+		return nil, fmt.Errorf("获取证书时发生错误，%v %s", err, output)
 	}
-	return certificates, nil
+	return parseBase64Certificates(output), nil
 }
+
 func fetchCertificatesInMacOS() ([]Certificate, error) {
-	cmd := exec.Command("security", "find-certificate", "-a")
-	output, err2 := cmd.Output()
-	if err2 != nil {
-		return nil, errors.New(fmt.Sprintf("获取证书时发生错误，%v\n", err2.Error()))
+	// -Z 输出指纹，-p 输出 PEM 格式的证书
+	output, err := runner.Run("security", "find-certificate", "-a", "-Z", "-p")
+	if err != nil {
+		return nil, fmt.Errorf("获取证书时发生错误，%v %s", err, output)
 	}
-	var certificates []Certificate
-	lines := strings.Split(string(output), "\n")
-	for i := 0; i < len(lines)-1; i += 13 {
-		if lines[i] == "" {
-			continue
-		}
-		// if i > len(lines)-1 {
-		// 	continue
-		// }
-		cenc := lines[i+5]
-		ctyp := lines[i+6]
-		hpky := lines[i+7]
-		labl := lines[i+9]
-		subj := lines[i+12]
-		re := regexp.MustCompile(`="([^"]{1,})"`)
-		// 找到匹配的字符串
-		matches := re.FindStringSubmatch(labl)
-		if len(matches) < 1 {
-			continue
-		}
-		label := matches[1]
-		certificates = append(certificates, Certificate{
-			Thumbprint: "",
-			Subject: Subject{
-				CN: label,
-				OU: cenc,
-				O:  ctyp,
-				L:  hpky,
-				S:  subj,
-				C:  cenc,
-			},
-		})
-	}
-	return certificates, nil
+	return parseSecurityOutput(output), nil
 }
 
 func fetchCertificates() ([]Certificate, error) {
 	os_env := runtime.GOOS
 	switch os_env {
 	case "linux":
-		fmt.Println("Running on Linux")
+		return fetchCertificatesInLinux()
 	case "darwin":
 		return fetchCertificatesInMacOS()
 	case "windows":
 		return fetchCertificatesInWindows()
 	default:
-		fmt.Printf("Running on %s\n", os_env)
+		slog.Warn("不支持的系统", "os", os_env)
 	}
 	return nil, errors.New(fmt.Sprintf("unknown OS\n"))
 
 }
-func CheckCertificate(cert_name string) (bool, error) {
+
+// 根据 SHA-256 指纹检查证书是否已经安装
+func CheckCertificate(fingerprint string) (bool, error) {
 	certificates, err := fetchCertificates()
 	if err != nil {
 		return false, err
 	}
+	fingerprint = NormalizeFingerprint(fingerprint)
 	for _, cert := range certificates {
-		if cert.Subject.CN == cert_name {
+		if cert.SHA256 == fingerprint {
 			return true, nil
 		}
 	}
 	return false, nil
 }
-func removeCertificate() {
-	// 删除指定证书
-	// Remove-Item "Cert:\LocalMachine\Root\D70CD039051F77C30673B8209FC15EFA650ED52C"
+
+// 查找系统中所有指纹相同的证书
+func FindCertificate(fingerprint string) ([]Installed, error) {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	var certificates []Certificate
+	var err error
+	store := ""
+	switch runtime.GOOS {
+	case "linux":
+		return findCertificateInLinux(fingerprint)
+	case "darwin":
+		store = "keychain"
+		certificates, err = fetchCertificatesInMacOS()
+	case "windows":
+		store = "Cert:\\LocalMachine\\Root"
+		certificates, err = fetchCertificatesInWindows()
+	default:
+		return nil, fmt.Errorf("unknown OS")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var found []Installed
+	for _, cert := range certificates {
+		if cert.SHA256 == fingerprint {
+			found = append(found, Installed{Store: store, Name: cert.Subject.CN, Certificate: cert})
+		}
+	}
+	return found, nil
+}
+
+// 删除系统中所有指纹相同的证书，返回已删除的证书
+func UninstallCertificate(fingerprint string) ([]Installed, error) {
+	found, err := FindCertificate(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	var removed []Installed
+	for _, item := range found {
+		if err := removeCertificate(item); err != nil {
+			return removed, err
+		}
+		removed = append(removed, item)
+	}
+	if runtime.GOOS == "linux" {
+		if err := refreshLinuxStores(removed); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func removeCertificate(item Installed) error {
+	switch runtime.GOOS {
+	case "linux":
+		return removeCertificateInLinux(item)
+	case "darwin":
+		cert_file, err := os.CreateTemp("", certFileName(item.Subject.CN)+"-*.pem")
+		if err != nil {
+			return fmt.Errorf("没有创建证书的权限，%v", err)
+		}
+		defer os.Remove(cert_file.Name())
+		cert_file.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: item.Raw}))
+		cert_file.Close()
+		// 安装时使用 -d 添加了信任设置，先删除信任设置再删除证书
+		runner.Run("security", "remove-trusted-cert", "-d", cert_file.Name())
+		output, err := runner.Run("security", "delete-certificate", "-Z", item.Thumbprint)
+		if err != nil {
+			return fmt.Errorf("删除证书时发生错误，%v %s", err, output)
+		}
+		return nil
+	case "windows":
+		output, err := runner.Run("powershell.exe", "-Command", fmt.Sprintf("Remove-Item 'Cert:\\LocalMachine\\Root\\%s'", item.Thumbprint))
+		if err != nil {
+			return fmt.Errorf("删除证书时发生错误，%v %s", err, output)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown OS")
 }
 func installCertificateInWindows(cert_data []byte) error {
-	cert_file, err := os.CreateTemp("", "SunnyRoot.cer")
+	cert_file, err := os.CreateTemp("", certFileName(certName(cert_data))+"-*.cer")
 	if err != nil {
 		return errors.New(fmt.Sprintf("没有创建证书的权限，%v\n", err.Error()))
 	}
@@ -166,7 +185,7 @@ func installCertificateInWindows(cert_data []byte) error {
 	return nil
 }
 func installCertificateInMacOS(cert_data []byte) error {
-	cert_file, err := os.CreateTemp("", "SunnyRoot.cer")
+	cert_file, err := os.CreateTemp("", certFileName(certName(cert_data))+"-*.cer")
 	if err != nil {
 		return errors.New(fmt.Sprintf("没有创建证书的权限，%v\n", err.Error()))
 	}
@@ -190,13 +209,13 @@ func InstallCertificate(cert_data []byte) error {
 	os_env := runtime.GOOS
 	switch os_env {
 	case "linux":
-		fmt.Println("Running on Linux")
+		return installCertificateInLinux(cert_data)
 	case "darwin":
 		return installCertificateInMacOS(cert_data)
 	case "windows":
 		return installCertificateInWindows(cert_data)
 	default:
-		fmt.Printf("Running on %s\n", os_env)
+		slog.Warn("不支持的系统", "os", os_env)
 	}
 	return errors.New(fmt.Sprintf("unknown OS\n"))
 }
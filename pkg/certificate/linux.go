@@ -0,0 +1,335 @@
+package certificate
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// 各发行版的证书包，按顺序使用第一个存在的文件
+var linuxBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Arch
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // Fedora/RHEL
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+}
+
+// 发行版的证书管理方式
+type linuxStore struct {
+	// 检查是否存在的命令
+	tool string
+	// 证书放置的目录，为空时由命令自己保存，目录不存在时说明不是该发行版，不会创建
+	dir string
+	ext string
+	// 安装证书的命令，{file} 会替换为证书文件
+	install []string
+}
+
+// 同一个命令在不同发行版中读取的目录不同，按目录是否存在区分，都不存在时使用 trust anchor
+var linuxStores = []linuxStore{
+	{tool: "update-ca-certificates", dir: "/usr/local/share/ca-certificates", ext: ".crt", install: []string{"update-ca-certificates"}}, // Debian/Ubuntu
+	{tool: "update-ca-certificates", dir: "/etc/pki/trust/anchors", ext: ".pem", install: []string{"update-ca-certificates"}},           // openSUSE
+	{tool: "update-ca-trust", dir: "/etc/pki/ca-trust/source/anchors", ext: ".pem", install: []string{"update-ca-trust", "extract"}},    // Fedora/RHEL
+	{tool: "update-ca-trust", dir: "/etc/ca-certificates/trust-source/anchors", ext: ".crt", install: []string{"update-ca-trust"}},      // Arch
+	{tool: "trust", install: []string{"trust", "anchor", "--store", "{file}"}},
+}
+
+// 系统目录的根目录，测试时替换为临时目录
+var linuxRoot = "/"
+
+func linuxPath(path string) string {
+	return filepath.Join(linuxRoot, path)
+}
+
+func fetchCertificatesInLinux() ([]Certificate, error) {
+	for _, bundle := range linuxBundles {
+		data, err := os.ReadFile(linuxPath(bundle))
+		if err != nil {
+			continue
+		}
+		return parsePEMBundle(data), nil
+	}
+	return nil, errors.New("没有找到系统证书文件")
+}
+
+func installCertificateInLinux(cert_data []byte) error {
+	pem_data, err := toPEM(cert_data)
+	if err != nil {
+		return err
+	}
+	name := certName(pem_data)
+	if err := installCertificateInLinuxSystem(pem_data, certFileName(name)); err != nil {
+		return err
+	}
+	// 浏览器使用自己的 NSS 证书库，失败时不影响系统证书
+	for _, err := range installCertificateInNSS(pem_data, name) {
+		slog.Warn("安装到浏览器证书库失败", "error", err)
+	}
+	return nil
+}
+
+// file_name 为证书目录中的文件名，不包含扩展名
+func installCertificateInLinuxSystem(pem_data []byte, file_name string) error {
+	for _, store := range linuxStores {
+		if _, err := runner.LookPath(store.tool); err != nil {
+			continue
+		}
+		cert_path := ""
+		if store.dir != "" {
+			if info, err := os.Stat(linuxPath(store.dir)); err != nil || !info.IsDir() {
+				continue
+			}
+			cert_path = filepath.Join(linuxPath(store.dir), file_name+store.ext)
+			if err := os.WriteFile(cert_path, pem_data, 0644); err != nil {
+				return fmt.Errorf("没有安装证书的权限，请使用 sudo 运行，%v", err)
+			}
+		} else {
+			cert_file, err := os.CreateTemp("", file_name+"-*.pem")
+			if err != nil {
+				return fmt.Errorf("没有创建证书的权限，%v", err)
+			}
+			defer os.Remove(cert_file.Name())
+			if _, err := cert_file.Write(pem_data); err != nil {
+				cert_file.Close()
+				return fmt.Errorf("生成证书失败，%v", err)
+			}
+			if err := cert_file.Close(); err != nil {
+				return fmt.Errorf("生成证书失败，%v", err)
+			}
+			cert_path = cert_file.Name()
+		}
+		args := make([]string, len(store.install))
+		for i, a := range store.install {
+			args[i] = strings.ReplaceAll(a, "{file}", cert_path)
+		}
+		output, err := runner.Run(args[0], args[1:]...)
+		if err != nil {
+			return fmt.Errorf("安装证书时发生错误，%v %s", err, output)
+		}
+		return nil
+	}
+	return errors.New("没有找到 update-ca-certificates、update-ca-trust 使用的证书目录或 trust 命令，请手动安装证书")
+}
+
+// 当前用户的主目录，使用 sudo 运行时返回原用户的主目录
+func homeDirs() []string {
+	var dirs []string
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		if u, err := user.Lookup(name); err == nil {
+			dirs = append(dirs, u.HomeDir)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, home)
+	}
+	return dirs
+}
+
+// Chromium 和 Firefox 使用的 NSS 证书库目录
+func nssDatabases() []string {
+	var dbs []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if seen[dir] {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err != nil {
+			return
+		}
+		seen[dir] = true
+		dbs = append(dbs, dir)
+	}
+	for _, home := range homeDirs() {
+		add(filepath.Join(home, ".pki", "nssdb"))
+		for _, pattern := range []string{
+			filepath.Join(home, ".mozilla", "firefox", "*"),
+			filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"),
+		} {
+			profiles, _ := filepath.Glob(pattern)
+			for _, profile := range profiles {
+				add(profile)
+			}
+		}
+	}
+	return dbs
+}
+
+// nickname 为 NSS 证书库中的名称
+func installCertificateInNSS(pem_data []byte, nickname string) []error {
+	dbs := nssDatabases()
+	if len(dbs) == 0 {
+		return nil
+	}
+	if _, err := runner.LookPath("certutil"); err != nil {
+		return []error{errors.New("没有找到 certutil 命令，浏览器中的证书需要手动安装（Debian/Ubuntu 安装 libnss3-tools，Fedora 安装 nss-tools）")}
+	}
+	cert_file, err := os.CreateTemp("", certFileName(nickname)+"-*.pem")
+	if err != nil {
+		return []error{fmt.Errorf("没有创建证书的权限，%v", err)}
+	}
+	defer os.Remove(cert_file.Name())
+	cert_file.Write(pem_data)
+	cert_file.Close()
+	var errs []error
+	for _, db := range dbs {
+		output, err := runner.Run("certutil", "-d", "sql:"+db, "-A", "-t", "C,,", "-n", nickname, "-i", cert_file.Name())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("安装证书到 %s 时发生错误，%v %s", db, err, output))
+		}
+	}
+	return errs
+}
+
+// 在系统证书目录、trust 和 NSS 证书库中查找指纹相同的证书
+func findCertificateInLinux(fingerprint string) ([]Installed, error) {
+	var found []Installed
+	for _, store := range linuxStores {
+		if store.dir == "" {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(linuxPath(store.dir), "*"))
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			if pem_data, err := toPEM(data); err == nil {
+				data = pem_data
+			}
+			for _, cert := range parsePEMBundle(data) {
+				if cert.SHA256 == fingerprint {
+					found = append(found, Installed{Store: store.dir, Name: file, Certificate: cert})
+				}
+			}
+		}
+	}
+	// 使用 trust anchor 安装的证书没有固定的文件，只能从证书包中确认
+	if len(found) == 0 {
+		if _, err := runner.LookPath("trust"); err == nil {
+			certificates, _ := fetchCertificatesInLinux()
+			for _, cert := range certificates {
+				if cert.SHA256 == fingerprint {
+					found = append(found, Installed{Store: "trust", Name: cert.Subject.CN, Certificate: cert})
+				}
+			}
+		}
+	}
+	nss, err := findCertificateInNSS(fingerprint)
+	if err != nil {
+		return found, err
+	}
+	return append(found, nss...), nil
+}
+
+func findCertificateInNSS(fingerprint string) ([]Installed, error) {
+	dbs := nssDatabases()
+	if len(dbs) == 0 {
+		return nil, nil
+	}
+	if _, err := runner.LookPath("certutil"); err != nil {
+		return nil, nil
+	}
+	var found []Installed
+	for _, db := range dbs {
+		output, err := runner.Run("certutil", "-d", "sql:"+db, "-L")
+		if err != nil {
+			return found, fmt.Errorf("读取 %s 中的证书失败，%v %s", db, err, output)
+		}
+		for _, nickname := range parseNSSNicknames(output) {
+			output, err := runner.Run("certutil", "-d", "sql:"+db, "-L", "-n", nickname, "-a")
+			if err != nil {
+				continue
+			}
+			for _, cert := range parsePEMBundle(output) {
+				if cert.SHA256 == fingerprint {
+					found = append(found, Installed{Store: "sql:" + db, Name: nickname, Certificate: cert})
+					break
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// 解析 certutil -L 输出的证书名称，最后一列是信任属性
+func parseNSSNicknames(output []byte) []string {
+	var nicknames []string
+	header := true
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if header {
+			if strings.Contains(line, "SSL,S/MIME,JAR/XPI") {
+				header = false
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		trust := fields[len(fields)-1]
+		nickname := strings.TrimSpace(strings.TrimSuffix(line, trust))
+		if nickname != "" {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return nicknames
+}
+
+func removeCertificateInLinux(item Installed) error {
+	switch {
+	case strings.HasPrefix(item.Store, "sql:"):
+		output, err := runner.Run("certutil", "-d", item.Store, "-D", "-n", item.Name)
+		if err != nil {
+			return fmt.Errorf("从 %s 删除证书时发生错误，%v %s", item.Store, err, output)
+		}
+	case item.Store == "trust":
+		cert_file, err := os.CreateTemp("", certFileName(item.Subject.CN)+"-*.pem")
+		if err != nil {
+			return fmt.Errorf("没有创建证书的权限，%v", err)
+		}
+		defer os.Remove(cert_file.Name())
+		cert_file.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: item.Raw}))
+		cert_file.Close()
+		output, err := runner.Run("trust", "anchor", "--remove", cert_file.Name())
+		if err != nil {
+			return fmt.Errorf("删除证书时发生错误，%v %s", err, output)
+		}
+	default:
+		if err := os.Remove(item.Name); err != nil {
+			return fmt.Errorf("没有删除证书的权限，请使用 sudo 运行，%v", err)
+		}
+	}
+	return nil
+}
+
+// 删除证书目录中的文件后，重新生成系统证书包
+func refreshLinuxStores(removed []Installed) error {
+	for _, store := range linuxStores {
+		if store.dir == "" {
+			continue
+		}
+		changed := false
+		for _, item := range removed {
+			if item.Store == store.dir {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if _, err := runner.LookPath(store.tool); err != nil {
+			continue
+		}
+		output, err := runner.Run(store.install[0], store.install[1:]...)
+		if err != nil {
+			return fmt.Errorf("更新系统证书时发生错误，%v %s", err, output)
+		}
+	}
+	return nil
+}
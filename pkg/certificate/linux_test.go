@@ -0,0 +1,144 @@
+package certificate
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 只记录执行的命令，证书文件在命令返回后会被删除，执行时保存内容
+type fakeRunner struct {
+	tools map[string]bool
+	calls [][]string
+	files map[string][]byte
+}
+
+func (r *fakeRunner) LookPath(name string) (string, error) {
+	if r.tools[name] {
+		return "/usr/bin/" + name, nil
+	}
+	return "", exec.ErrNotFound
+}
+
+func (r *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	r.calls = append(r.calls, append([]string{name}, args...))
+	for _, arg := range args {
+		if data, err := os.ReadFile(arg); err == nil {
+			r.files[arg] = data
+		}
+	}
+	return nil, nil
+}
+
+// 模拟发行版的目录和命令安装证书，返回的文件名不包含扩展名
+func installInFakeLinux(t *testing.T, tools []string, dirs []string) (*fakeRunner, string, string, error) {
+	t.Helper()
+	root := t.TempDir()
+	prev_root := linuxRoot
+	linuxRoot = root
+	t.Cleanup(func() { linuxRoot = prev_root })
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &fakeRunner{tools: make(map[string]bool), files: make(map[string][]byte)}
+	for _, tool := range tools {
+		r.tools[tool] = true
+	}
+	prev := SetRunner(r)
+	t.Cleanup(func() { SetRunner(prev) })
+	ca := testCA(t)
+	name := certFileName(ca.Name())
+	return r, root, name, installCertificateInLinuxSystem(ca.CertPEM, name)
+}
+
+func TestInstallCertificateInLinuxSystem(t *testing.T) {
+	for _, tt := range []struct {
+		distro string
+		tools  []string
+		dirs   []string
+		file   string
+		cmd    []string
+	}{
+		{
+			distro: "Debian",
+			tools:  []string{"update-ca-certificates"},
+			dirs:   []string{"/usr/local/share/ca-certificates"},
+			file:   "/usr/local/share/ca-certificates/{name}.crt",
+			cmd:    []string{"update-ca-certificates"},
+		},
+		{
+			distro: "openSUSE",
+			tools:  []string{"update-ca-certificates"},
+			dirs:   []string{"/etc/pki/trust/anchors"},
+			file:   "/etc/pki/trust/anchors/{name}.pem",
+			cmd:    []string{"update-ca-certificates"},
+		},
+		{
+			distro: "Fedora",
+			tools:  []string{"update-ca-trust", "trust"},
+			dirs:   []string{"/etc/pki/ca-trust/source/anchors"},
+			file:   "/etc/pki/ca-trust/source/anchors/{name}.pem",
+			cmd:    []string{"update-ca-trust", "extract"},
+		},
+		{
+			// update-ca-trust 也存在，但是不读取 /etc/pki/ca-trust
+			distro: "Arch",
+			tools:  []string{"update-ca-trust", "trust"},
+			dirs:   []string{"/etc/ca-certificates/trust-source/anchors"},
+			file:   "/etc/ca-certificates/trust-source/anchors/{name}.crt",
+			cmd:    []string{"update-ca-trust"},
+		},
+		{
+			distro: "only trust",
+			tools:  []string{"update-ca-trust", "trust"},
+			cmd:    []string{"trust", "anchor", "--store"},
+		},
+	} {
+		t.Run(tt.distro, func(t *testing.T) {
+			r, root, name, err := installInFakeLinux(t, tt.tools, tt.dirs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.calls) != 1 {
+				t.Fatalf("calls = %q", r.calls)
+			}
+			if tt.file == "" {
+				// trust anchor --store 临时文件
+				call := r.calls[0]
+				if !reflect.DeepEqual(call[:len(call)-1], tt.cmd) || !strings.Contains(string(r.files[call[len(call)-1]]), "BEGIN CERTIFICATE") {
+					t.Fatalf("calls = %q", r.calls)
+				}
+				return
+			}
+			if !reflect.DeepEqual(r.calls[0], tt.cmd) {
+				t.Fatalf("calls = %q, want %q", r.calls, tt.cmd)
+			}
+			if !strings.HasPrefix(name, "WxChannelsDownload_CA_") {
+				t.Fatalf("文件名 %s", name)
+			}
+			data, err := os.ReadFile(filepath.Join(root, strings.ReplaceAll(tt.file, "{name}", name)))
+			if err != nil || !bytes.Contains(data, []byte("BEGIN CERTIFICATE")) {
+				t.Fatalf("证书没有写入 %s，%v", tt.file, err)
+			}
+			// 不应该创建其他发行版的目录
+			if tt.distro == "Arch" {
+				if _, err := os.Stat(filepath.Join(root, "/etc/pki")); err == nil {
+					t.Fatal("创建了 /etc/pki")
+				}
+			}
+		})
+	}
+}
+
+func TestInstallCertificateInLinuxSystemNoTool(t *testing.T) {
+	r, _, _, err := installInFakeLinux(t, nil, []string{"/usr/local/share/ca-certificates"})
+	if err == nil || len(r.calls) != 0 {
+		t.Fatalf("err = %v, calls = %q", err, r.calls)
+	}
+}
@@ -0,0 +1,162 @@
+package certificate
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// 解析各系统证书库的输出，都转换为 DER 格式的证书后再计算指纹，不依赖输出中的名称
+
+// 将指纹转换为大写且没有分隔符的形式，方便比较
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(fingerprint)
+	return strings.NewReplacer(":", "", " ", "", "-", "").Replace(fingerprint)
+}
+
+// 旧版本安装的 SunnyNet 根证书，私钥随 SunnyNet 一起公开，任何人都可以用它签发证书
+const LegacySunnyFingerprint = "1A61D4F74DC31D27630B25E37AAF46C364955EDC7A6EA11EB20E4B6B05114E04"
+
+// 安装到证书库时使用的名称，和证书的 CN 相同，每次生成的根证书都不相同
+func certName(cert_data []byte) string {
+	data := cert_data
+	if block, _ := pem.Decode(cert_data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil || cert.Subject.CommonName == "" {
+		return "wx_channels_download"
+	}
+	return cert.Subject.CommonName
+}
+
+// 用作文件名时只保留字母、数字、- 和 _
+func certFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// 转换为 PEM 格式，传入 DER 或 PEM 都可以
+func toPEM(cert_data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(cert_data); block != nil {
+		return cert_data, nil
+	}
+	if _, err := x509.ParseCertificate(cert_data); err != nil {
+		return nil, fmt.Errorf("证书格式错误，%v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert_data}), nil
+}
+
+// 解析 PEM 证书包中的所有证书
+func parsePEMBundle(data []byte) []Certificate {
+	var certificates []Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certificates = append(certificates, certificateFromX509(cert))
+	}
+	return certificates
+}
+
+func certificateFromX509(cert *x509.Certificate) Certificate {
+	sum := sha1.Sum(cert.Raw)
+	sum256 := sha256.Sum256(cert.Raw)
+	subject := Subject{CN: cert.Subject.CommonName}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		subject.OU = cert.Subject.OrganizationalUnit[0]
+	}
+	if len(cert.Subject.Organization) > 0 {
+		subject.O = cert.Subject.Organization[0]
+	}
+	if len(cert.Subject.Locality) > 0 {
+		subject.L = cert.Subject.Locality[0]
+	}
+	if len(cert.Subject.Province) > 0 {
+		subject.S = cert.Subject.Province[0]
+	}
+	if len(cert.Subject.Country) > 0 {
+		subject.C = cert.Subject.Country[0]
+	}
+	return Certificate{
+		Thumbprint: strings.ToUpper(hex.EncodeToString(sum[:])),
+		SHA256:     strings.ToUpper(hex.EncodeToString(sum256[:])),
+		Subject:    subject,
+		Raw:        cert.Raw,
+	}
+}
+
+// 解析每行一个 base64 编码的 DER 证书，Windows 中 [Convert]::ToBase64String($_.RawData) 的输出
+func parseBase64Certificates(output []byte) []Certificate {
+	var certificates []Certificate
+	for _, line := range strings.Split(string(output), "\n") {
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil || len(der) == 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		certificates = append(certificates, certificateFromX509(cert))
+	}
+	return certificates
+}
+
+// 解析 macOS 中 security find-certificate -a -Z -p 的输出，每个证书的格式为
+//
+//	SHA-256 hash: 8F43...
+//	SHA-1 hash: D70C...
+//	-----BEGIN CERTIFICATE-----
+//	...
+//	-----END CERTIFICATE-----
+//
+// 旧版本的系统只输出 SHA-1，输出了指纹时会和证书内容校验
+func parseSecurityOutput(output []byte) []Certificate {
+	var certificates []Certificate
+	var sha256_hash, sha1_hash string
+	var block []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "SHA-256 hash:"):
+			sha256_hash = NormalizeFingerprint(strings.TrimPrefix(line, "SHA-256 hash:"))
+		case strings.HasPrefix(line, "SHA-1 hash:"):
+			sha1_hash = NormalizeFingerprint(strings.TrimPrefix(line, "SHA-1 hash:"))
+		case line == "-----BEGIN CERTIFICATE-----":
+			block = []string{line}
+		case block != nil:
+			block = append(block, line)
+			if line != "-----END CERTIFICATE-----" {
+				continue
+			}
+			certs := parsePEMBundle([]byte(strings.Join(block, "\n")))
+			for _, cert := range certs {
+				if (sha256_hash == "" || sha256_hash == cert.SHA256) && (sha1_hash == "" || sha1_hash == cert.Thumbprint) {
+					certificates = append(certificates, cert)
+				}
+			}
+			block = nil
+			sha256_hash, sha1_hash = "", ""
+		}
+	}
+	return certificates
+}
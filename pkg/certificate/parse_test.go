@@ -0,0 +1,79 @@
+package certificate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	isrgRootX1    = "96BCEC06264976F37460779ACF28C5A7CFE8A3C0AAE11A8FFCEE05C0BDDF08C6"
+	digicertG2    = "CB3CCBB76031E5E0138F8DD39A23F9DE47FFC35E43C1144CEA27D46A5AB1CB5F"
+	globalSignCA  = "EBD41040E4BB3EC742C9E381D31EF2A41A48B6685C96E7CEF3C1DF6CD4331C99"
+	gtsRootR1     = "D947432ABDE7B7FA90FC2E6B59101B1280E0E1C7E4E40FA3C6887FFF57A7F4CF"
+	isrgRootX1SHA = "CABD2A79A1076A31F21D253635CB039D4329A5E8"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func fingerprints(certificates []Certificate) []string {
+	var out []string
+	for _, cert := range certificates {
+		out = append(out, cert.SHA256)
+	}
+	return out
+}
+
+func TestParseCertificateStores(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		fixture string
+		parse   func([]byte) []Certificate
+		want    []string
+	}{
+		// 最后一个证书的指纹和内容不一致，需要跳过；GlobalSign 只有 SHA-1
+		{"macOS security", "security_find_certificate.txt", parseSecurityOutput, []string{isrgRootX1, digicertG2, globalSignCA}},
+		// CRLF 换行，空行和不完整的证书需要跳过
+		{"Windows base64", "windows_base64.txt", parseBase64Certificates, []string{isrgRootX1, globalSignCA, digicertG2}},
+		// 注释和 PUBLIC KEY 需要跳过
+		{"Linux PEM bundle", "ca-certificates.crt", parsePEMBundle, []string{isrgRootX1, gtsRootR1, digicertG2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.parse(readFixture(t, tt.fixture))
+			if !reflect.DeepEqual(fingerprints(got), tt.want) {
+				t.Fatalf("got %v, want %v", fingerprints(got), tt.want)
+			}
+			if got[0].Subject.CN != "ISRG Root X1" || got[0].Subject.O != "Internet Security Research Group" || got[0].Thumbprint != isrgRootX1SHA {
+				t.Fatalf("got %+v", got[0].Subject)
+			}
+		})
+	}
+}
+
+func TestParseNSSNicknames(t *testing.T) {
+	got := parseNSSNicknames(readFixture(t, "certutil_L.txt"))
+	want := []string{
+		"SunnyRoot",
+		"WxChannelsDownload CA 49C45AE1",
+		"DigiCert Global Root G2 - DigiCert Inc",
+		"ISRG Root X1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	got := NormalizeFingerprint("ca:bd:2a 79-a1")
+	if got != "CABD2A79A1" {
+		t.Fatalf("got %s", got)
+	}
+}
@@ -0,0 +1,304 @@
+package certificate
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"unicode/utf16"
+)
+
+// 生成 PKCS#12 (RFC 7292) 文件，私钥使用 pbeWithSHAAnd3-KeyTripleDES-CBC 加密，
+// 校验使用 HMAC-SHA1，这是各系统和浏览器都能导入的格式
+// 默认只包含根证书，在其他设备上信任根证书不需要私钥
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const pkcs12Iterations = 2048
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// [0] EXPLICIT，RawValue 不会处理 tag，需要自己设置
+	Content asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+type safeBag struct {
+	ID asn1.ObjectIdentifier
+	// [0] EXPLICIT
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// 将根证书编码为 PKCS#12，include_key 为 true 时同时包含私钥，password 可以为空
+func (ca *CA) PKCS12(password string, include_key bool) ([]byte, error) {
+	pass := bmpString(password)
+	var local_key_id []byte
+	if include_key {
+		sum := sha1.Sum(ca.Cert.Raw)
+		local_key_id = sum[:]
+	}
+	attrs, err := bagAttributes(local_key_id, ca.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	cert_value, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: ca.Cert.Raw})
+	if err != nil {
+		return nil, err
+	}
+	cert_safe, err := asn1.Marshal([]safeBag{{
+		ID:         oidCertBag,
+		Value:      explicit(cert_value),
+		Attributes: attrs,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	safes := [][]byte{cert_safe}
+	if include_key {
+		key_safe, err := ca.keySafe(pass, attrs)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, key_safe)
+	}
+
+	var auth_safe []contentInfo
+	for _, safe := range safes {
+		ci, err := dataContentInfo(safe)
+		if err != nil {
+			return nil, err
+		}
+		auth_safe = append(auth_safe, ci)
+	}
+	auth_safe_der, err := asn1.Marshal(auth_safe)
+	if err != nil {
+		return nil, err
+	}
+	outer, err := dataContentInfo(auth_safe_der)
+	if err != nil {
+		return nil, err
+	}
+
+	mac_salt := make([]byte, 8)
+	if _, err := rand.Read(mac_salt); err != nil {
+		return nil, err
+	}
+	mac_key := pkcs12KDF(pass, mac_salt, pkcs12Iterations, 3, 20)
+	h := hmac.New(sha1.New, mac_key)
+	h.Write(auth_safe_der)
+	return asn1.Marshal(pfxPDU{
+		Version:  3,
+		AuthSafe: outer,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: algorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    h.Sum(nil),
+			},
+			MacSalt:    mac_salt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// 加密后的私钥
+func (ca *CA) keySafe(pass []byte, attrs []pkcs12Attribute) ([]byte, error) {
+	key_der, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encrypted, err := pbeEncrypt(key_der, pass, salt, pkcs12Iterations)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	key_value, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     algorithmIdentifier{Algorithm: oidPBEWithSHAAnd3KeyDES, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal([]safeBag{{
+		ID:         oidPKCS8ShroudedKeyBag,
+		Value:      explicit(key_value),
+		Attributes: attrs,
+	}})
+}
+
+// 内容为 OCTET STRING 的 ContentInfo
+func dataContentInfo(data []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{
+		ContentType: oidData,
+		Content:     explicit(octets),
+	}, nil
+}
+
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// local_key_id 为空时不包含私钥，只设置 friendlyName
+func bagAttributes(local_key_id []byte, friendly_name string) ([]pkcs12Attribute, error) {
+	name := bmpString(friendly_name)
+	// 去掉末尾的两个 0，friendlyName 中不需要
+	name_der, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: name_der}},
+	}
+	if len(local_key_id) == 0 {
+		return attrs, nil
+	}
+	id, err := asn1.Marshal(local_key_id)
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, pkcs12Attribute{ID: oidLocalKeyID, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: id}})
+	return attrs, nil
+}
+
+func pbeEncrypt(data, password, salt []byte, iterations int) ([]byte, error) {
+	key := pkcs12KDF(password, salt, iterations, 1, 24)
+	iv := pkcs12KDF(password, salt, iterations, 2, 8)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(data)%block.BlockSize()
+	out := make([]byte, len(data)+padding)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+// 密码使用 UTF-16BE 编码，并以两个 0 结尾
+func bmpString(s string) []byte {
+	var out []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
+
+// RFC 7292 附录 B.2 中的密钥派生算法，使用 SHA-1
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(src)+v-1)/v))
+		for i := range out {
+			out[i] = src[i%len(src)]
+		}
+		return out
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	input := append(fill(salt), fill(password)...)
+	one := big.NewInt(1)
+	var result []byte
+	for len(result) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(input)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		result = append(result, a...)
+		// I_j = (I_j + B + 1) mod 2^(v*8)
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(input); j += v {
+			n := new(big.Int).SetBytes(input[j : j+v])
+			n.Add(n, b)
+			bytes := n.Bytes()
+			if len(bytes) > v {
+				bytes = bytes[len(bytes)-v:]
+			}
+			block := input[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(bytes):], bytes)
+		}
+	}
+	return result[:size]
+}
@@ -0,0 +1,247 @@
+package certificate
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func testCA(t *testing.T) *CA {
+	t.Helper()
+	ca, err := createCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// golang.org/x/crypto/pkcs12 和 openssl kdf PKCS12KDF 的结果
+func TestPKCS12KDF(t *testing.T) {
+	salt := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	got := pkcs12KDF(bmpString("sesame"), salt, 2048, 1, 24)
+	want, _ := hex.DecodeString("7cd9fd3e2b3be7691a44e3bef0f9ea0fb9b897d4e325d9d1")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("pkcs12KDF = %x, want %x", got, want)
+	}
+}
+
+type parsedPKCS12 struct {
+	certs []*x509.Certificate
+	keys  []*rsa.PrivateKey
+	names []string
+}
+
+// 按 RFC 7292 解析，校验 MAC 并解密私钥
+func parsePKCS12(t *testing.T, data []byte, password string) parsedPKCS12 {
+	t.Helper()
+	pass := bmpString(password)
+	var pfx pfxPDU
+	if rest, err := asn1.Unmarshal(data, &pfx); err != nil || len(rest) != 0 {
+		t.Fatalf("解析 PFX 失败，%v", err)
+	}
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidData) {
+		t.Fatalf("PFX 版本 %d 类型 %v", pfx.Version, pfx.AuthSafe.ContentType)
+	}
+	var auth_safe_der []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &auth_safe_der); err != nil {
+		t.Fatal(err)
+	}
+	mac_key := pkcs12KDF(pass, pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, 20)
+	h := hmac.New(sha1.New, mac_key)
+	h.Write(auth_safe_der)
+	if !hmac.Equal(h.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC 校验失败")
+	}
+
+	var result parsedPKCS12
+	var auth_safe []contentInfo
+	if _, err := asn1.Unmarshal(auth_safe_der, &auth_safe); err != nil {
+		t.Fatal(err)
+	}
+	for _, ci := range auth_safe {
+		var safe_der []byte
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &safe_der); err != nil {
+			t.Fatal(err)
+		}
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(safe_der, &bags); err != nil {
+			t.Fatal(err)
+		}
+		for _, bag := range bags {
+			for _, attr := range bag.Attributes {
+				if attr.ID.Equal(oidFriendlyName) {
+					var name asn1.RawValue
+					asn1.Unmarshal(attr.Value.Bytes, &name)
+					result.names = append(result.names, string(decodeBMP(name.Bytes)))
+				}
+			}
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					t.Fatal(err)
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result.certs = append(result.certs, cert)
+			case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				var info encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+					t.Fatal(err)
+				}
+				var params pbeParams
+				if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+					t.Fatal(err)
+				}
+				block, err := des.NewTripleDESCipher(pkcs12KDF(pass, params.Salt, params.Iterations, 1, 24))
+				if err != nil {
+					t.Fatal(err)
+				}
+				plain := make([]byte, len(info.EncryptedData))
+				cipher.NewCBCDecrypter(block, pkcs12KDF(pass, params.Salt, params.Iterations, 2, 8)).CryptBlocks(plain, info.EncryptedData)
+				padding := int(plain[len(plain)-1])
+				if padding == 0 || padding > 8 {
+					t.Fatalf("填充错误 %d", padding)
+				}
+				key, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-padding])
+				if err != nil {
+					t.Fatalf("解析私钥失败，%v", err)
+				}
+				result.keys = append(result.keys, key.(*rsa.PrivateKey))
+			default:
+				t.Fatalf("未知的 bag %v", bag.ID)
+			}
+		}
+	}
+	return result
+}
+
+func decodeBMP(b []byte) []rune {
+	var out []rune
+	for i := 0; i+1 < len(b); i += 2 {
+		out = append(out, rune(b[i])<<8|rune(b[i+1]))
+	}
+	return out
+}
+
+func TestPKCS12RoundTrip(t *testing.T) {
+	ca := testCA(t)
+	for _, tt := range []struct {
+		password    string
+		include_key bool
+	}{
+		{"", false},
+		{"", true},
+		{"密码 secret", false},
+		{"密码 secret", true},
+	} {
+		data, err := ca.PKCS12(tt.password, tt.include_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := parsePKCS12(t, data, tt.password)
+		if len(p.certs) != 1 || !p.certs[0].Equal(ca.Cert) {
+			t.Fatalf("password=%q include_key=%v 证书不一致", tt.password, tt.include_key)
+		}
+		if p.names[0] != ca.Name() {
+			t.Fatalf("friendlyName = %q, want %q", p.names[0], ca.Name())
+		}
+		if !tt.include_key {
+			if len(p.keys) != 0 {
+				t.Fatalf("password=%q 默认导出不应包含私钥", tt.password)
+			}
+			continue
+		}
+		if len(p.keys) != 1 || !p.keys[0].Equal(ca.Key) {
+			t.Fatalf("password=%q 私钥不一致", tt.password)
+		}
+	}
+}
+
+// 使用其他实现解析，golang.org/x/crypto/pkcs12 只支持同时包含证书和私钥的文件
+func TestPKCS12Decode(t *testing.T) {
+	ca := testCA(t)
+	for _, password := range []string{"", "密码 secret"} {
+		data, err := ca.PKCS12(password, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, cert, err := pkcs12.Decode(data, password)
+		if err != nil {
+			t.Fatalf("password=%q 解析失败，%v", password, err)
+		}
+		if !cert.Equal(ca.Cert) || !ca.Key.Equal(key) {
+			t.Fatalf("password=%q 证书或私钥不一致", password)
+		}
+		if _, _, err := pkcs12.Decode(data, password+"x"); err == nil {
+			t.Fatalf("password=%q 密码错误时应该解析失败", password)
+		}
+	}
+}
+
+// 使用 openssl pkcs12 解析，没有安装 openssl 时跳过
+func TestPKCS12OpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("没有安装 openssl")
+	}
+	ca := testCA(t)
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		password    string
+		include_key bool
+	}{
+		{"", false},
+		{"", true},
+		{"secret", false},
+		{"secret", true},
+	} {
+		data, err := ca.PKCS12(tt.password, tt.include_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "ca.p12")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(openssl, "pkcs12", "-in", path, "-passin", "pass:"+tt.password, "-nodes").Output()
+		if err != nil {
+			t.Fatalf("password=%q include_key=%v openssl 解析失败，%v", tt.password, tt.include_key, err)
+		}
+		var certs, keys int
+		for block, rest := pem.Decode(out); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil || !cert.Equal(ca.Cert) {
+					t.Fatalf("openssl 输出的证书不一致，%v", err)
+				}
+				certs++
+			case "PRIVATE KEY":
+				key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil || !ca.Key.Equal(key) {
+					t.Fatalf("openssl 输出的私钥不一致，%v", err)
+				}
+				keys++
+			}
+		}
+		if certs != 1 || (keys == 1) != tt.include_key {
+			t.Fatalf("password=%q include_key=%v openssl 输出 %d 个证书 %d 个私钥", tt.password, tt.include_key, certs, keys)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package certificate
+
+import (
+	"os/exec"
+)
+
+// 执行外部命令，测试时可以替换成假的实现
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+	LookPath(name string) (string, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (execRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+var runner Runner = execRunner{}
+
+// 替换执行命令的方式，返回原来的 Runner
+func SetRunner(r Runner) Runner {
+	prev := runner
+	runner = r
+	return prev
+}
@@ -0,0 +1,78 @@
+package decrypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 加密视频只有开头这部分内容被加密
+const KeystreamSize = 131072
+
+// 根据 decodeKey 生成解密用的密钥流
+// 等同于页面中 Module.WxIsaac64(seed).generate(131072) 之后再由 wasm_isaac_generate 反转得到的 decryptor_array
+func Keystream(seed string) ([]byte, error) {
+	s, err := strconv.ParseUint(strings.TrimSpace(seed), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("解析 decodeKey 失败，%v", err)
+	}
+	return Generate(s, KeystreamSize), nil
+}
+
+// 生成 size 字节的密钥流
+// size 不是 8 的倍数时按向上取整到 8 的倍数生成，反转之后截取前 size 字节
+func Generate(seed uint64, size int) []byte {
+	r := NewIsaac64(seed)
+	out := make([]byte, (size+7)/8*8)
+	// wasm 中按小端序逐个写入随机数
+	for i := 0; i < len(out); i += 8 {
+		binary.LittleEndian.PutUint64(out[i:], r.Rand())
+	}
+	// 页面拿到后会将整段内存反转
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out[:size]
+}
+
+// 对位于文件 offset 处的 buf 就地解密
+func XOR(buf []byte, key []byte, offset int64) {
+	if offset >= int64(len(key)) {
+		return
+	}
+	for i := range buf {
+		pos := offset + int64(i)
+		if pos >= int64(len(key)) {
+			break
+		}
+		buf[i] ^= key[pos]
+	}
+}
+
+// 边读边解密的 Reader
+type Reader struct {
+	r      io.Reader
+	key    []byte
+	offset int64
+}
+
+// 从文件开头读取
+func NewReader(r io.Reader, key []byte) *Reader {
+	return NewReaderAt(r, key, 0)
+}
+
+// r 的第一个字节位于原文件的 offset 处，用于断点续传等场景
+func NewReaderAt(r io.Reader, key []byte, offset int64) *Reader {
+	return &Reader{r: r, key: key, offset: offset}
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		XOR(p[:n], d.key, d.offset)
+		d.offset += int64(n)
+	}
+	return n, err
+}
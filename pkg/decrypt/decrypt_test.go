@@ -0,0 +1,119 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// 由 Bob Jenkins 的 isaac64.c（randinit(TRUE)，seed 放在 randrsl[0]）生成，
+// 按页面中的处理方式逐个以小端序写入 131072 字节后整段反转
+var keystreamVectors = []struct {
+	seed   string
+	first  string
+	last   string
+	sha256 string
+}{
+	{"2136343393", "77717be3fe41f933ec42b0626a79c348", "75d5a232994844ab23766a3699fb876a", "4aff3162c52002be6b16b6ebc6aeab6bb0de19fbc985b4d39fd779d6eb426adc"},
+	{"0", "d083427dd77ad6ef722fcb1f26624c46", "2af7398005aaa5c79d39247e33776d41", "5c33ae7db8ab8b79556515c16fb1c68aa5ce13e2e9a3f10bc893add0ba200c9d"},
+	{"18446744073709551615", "ee6bff46585862905b023a26f215003b", "64081892c82430f37c38fd3a2e7cd8ad", "b23a283cd1472dc09937cd6ca8f3bb61aedb880c8dede624ea5e6a0a214df1c3"},
+}
+
+func TestKeystream(t *testing.T) {
+	for _, tt := range keystreamVectors {
+		key, err := Keystream(tt.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != KeystreamSize {
+			t.Fatalf("seed %s len = %d", tt.seed, len(key))
+		}
+		if got := hex.EncodeToString(key[:16]); got != tt.first {
+			t.Errorf("seed %s 开头 %s，应为 %s", tt.seed, got, tt.first)
+		}
+		if got := hex.EncodeToString(key[len(key)-16:]); got != tt.last {
+			t.Errorf("seed %s 结尾 %s，应为 %s", tt.seed, got, tt.last)
+		}
+		sum := sha256.Sum256(key)
+		if got := hex.EncodeToString(sum[:]); got != tt.sha256 {
+			t.Errorf("seed %s sha256 %s，应为 %s", tt.seed, got, tt.sha256)
+		}
+	}
+	if _, err := Keystream("abc"); err == nil {
+		t.Fatal("decodeKey 不是数字时应该返回错误")
+	}
+}
+
+// 长度不是 8 的倍数时，结果是向上取整后的密钥流的开头，不会把补的 0 反转到开头
+func TestGenerateUnaligned(t *testing.T) {
+	key := Generate(2136343393, KeystreamSize)
+	for _, size := range []int{131071, 131065, 13, 1, 0} {
+		got := Generate(2136343393, size)
+		if len(got) != size {
+			t.Fatalf("size %d len = %d", size, len(got))
+		}
+		if size > KeystreamSize-8 && !bytes.Equal(got, key[:size]) {
+			t.Errorf("size %d 和 %d 字节的密钥流开头不同，%x", size, KeystreamSize, got[:16])
+		}
+		if aligned := Generate(2136343393, (size+7)/8*8); !bytes.Equal(got, aligned[:size]) {
+			t.Errorf("size %d 不是向上取整后的密钥流的开头", size)
+		}
+	}
+}
+
+// isaac64.c 中 seed 为 0 时 randvect.txt 的前两个数
+func TestIsaac64Vector(t *testing.T) {
+	r := NewIsaac64(0)
+	r.isaac64()
+	if r.randrsl[0] != 0x12a8f216af9418c2 || r.randrsl[1] != 0xd4490ad526f14431 {
+		t.Fatalf("randrsl = %x %x", r.randrsl[0], r.randrsl[1])
+	}
+}
+
+func TestXOR(t *testing.T) {
+	key, _ := Keystream("2136343393")
+	plain := make([]byte, KeystreamSize+1000)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	encrypted := append([]byte(nil), plain...)
+	XOR(encrypted, key, 0)
+	if !bytes.Equal(encrypted[KeystreamSize:], plain[KeystreamSize:]) {
+		t.Fatal("131072 字节之后的内容不应改变")
+	}
+	if bytes.Equal(encrypted[:KeystreamSize], plain[:KeystreamSize]) {
+		t.Fatal("开头的内容没有加密")
+	}
+	// 从任意位置分段解密，结果和一次解密相同
+	for _, offset := range []int{0, 1, 8191, 131071, 131072, 131500} {
+		buf := append([]byte(nil), encrypted[offset:]...)
+		XOR(buf, key, int64(offset))
+		if !bytes.Equal(buf, plain[offset:]) {
+			t.Fatalf("offset %d 解密结果不一致", offset)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	key, _ := Keystream("2136343393")
+	plain := make([]byte, KeystreamSize*2)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	encrypted := append([]byte(nil), plain...)
+	XOR(encrypted, key, 0)
+	for _, offset := range []int{0, 65537, KeystreamSize + 3} {
+		// 每次只读 1 字节也需要正确处理偏移
+		r := NewReaderAt(iotest.OneByteReader(bytes.NewReader(encrypted[offset:])), key, int64(offset))
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain[offset:]) {
+			t.Fatalf("offset %d 解密结果不一致", offset)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package decrypt
+
+// ISAAC64 伪随机数生成器，实现参考 Bob Jenkins 的 isaac64.c
+// 与视频号 wasm_video_decode 中的 WxIsaac64 行为一致
+
+const (
+	randSizL = 8
+	randSiz  = 1 << randSizL
+)
+
+type Isaac64 struct {
+	randrsl [randSiz]uint64
+	randcnt int
+	mm      [randSiz]uint64
+	aa      uint64
+	bb      uint64
+	cc      uint64
+}
+
+// 使用 seed 初始化生成器，seed 即视频信息中的 decodeKey
+func NewIsaac64(seed uint64) *Isaac64 {
+	r := &Isaac64{}
+	r.randrsl[0] = seed
+	r.init(true)
+	return r
+}
+
+func mix(a, b, c, d, e, f, g, h uint64) (uint64, uint64, uint64, uint64, uint64, uint64, uint64, uint64) {
+	a -= e
+	f ^= h >> 9
+	h += a
+	b -= f
+	g ^= a << 9
+	a += b
+	c -= g
+	h ^= b >> 23
+	b += c
+	d -= h
+	a ^= c << 15
+	c += d
+	e -= a
+	b ^= d >> 14
+	d += e
+	f -= b
+	c ^= e << 20
+	e += f
+	g -= c
+	d ^= f >> 17
+	f += g
+	h -= d
+	e ^= g << 14
+	g += h
+	return a, b, c, d, e, f, g, h
+}
+
+func (r *Isaac64) init(flag bool) {
+	r.aa, r.bb, r.cc = 0, 0, 0
+	a := uint64(0x9e3779b97f4a7c13)
+	b, c, d, e, f, g, h := a, a, a, a, a, a, a
+	for i := 0; i < 4; i++ {
+		a, b, c, d, e, f, g, h = mix(a, b, c, d, e, f, g, h)
+	}
+	for i := 0; i < randSiz; i += 8 {
+		if flag {
+			a += r.randrsl[i]
+			b += r.randrsl[i+1]
+			c += r.randrsl[i+2]
+			d += r.randrsl[i+3]
+			e += r.randrsl[i+4]
+			f += r.randrsl[i+5]
+			g += r.randrsl[i+6]
+			h += r.randrsl[i+7]
+		}
+		a, b, c, d, e, f, g, h = mix(a, b, c, d, e, f, g, h)
+		r.mm[i], r.mm[i+1], r.mm[i+2], r.mm[i+3] = a, b, c, d
+		r.mm[i+4], r.mm[i+5], r.mm[i+6], r.mm[i+7] = e, f, g, h
+	}
+	if flag {
+		// 再做一遍，让 seed 的每一位都影响到 mm 的每一位
+		for i := 0; i < randSiz; i += 8 {
+			a += r.mm[i]
+			b += r.mm[i+1]
+			c += r.mm[i+2]
+			d += r.mm[i+3]
+			e += r.mm[i+4]
+			f += r.mm[i+5]
+			g += r.mm[i+6]
+			h += r.mm[i+7]
+			a, b, c, d, e, f, g, h = mix(a, b, c, d, e, f, g, h)
+			r.mm[i], r.mm[i+1], r.mm[i+2], r.mm[i+3] = a, b, c, d
+			r.mm[i+4], r.mm[i+5], r.mm[i+6], r.mm[i+7] = e, f, g, h
+		}
+	}
+	r.isaac64()
+	r.randcnt = randSiz
+}
+
+func (r *Isaac64) ind(x uint64) uint64 {
+	return r.mm[(x>>3)&(randSiz-1)]
+}
+
+func (r *Isaac64) isaac64() {
+	r.cc++
+	a := r.aa
+	b := r.bb + r.cc
+	half := randSiz / 2
+	for i := 0; i < randSiz; i++ {
+		switch i % 4 {
+		case 0:
+			a = ^(a ^ (a << 21))
+		case 1:
+			a = a ^ (a >> 5)
+		case 2:
+			a = a ^ (a << 12)
+		case 3:
+			a = a ^ (a >> 33)
+		}
+		x := r.mm[i]
+		a += r.mm[(i+half)%randSiz]
+		y := r.ind(x) + a + b
+		r.mm[i] = y
+		b = r.ind(y>>randSizL) + x
+		r.randrsl[i] = b
+	}
+	r.bb = b
+	r.aa = a
+}
+
+// 返回下一个随机数，顺序与 isaac64.c 中的 rand 宏相同
+func (r *Isaac64) Rand() uint64 {
+	if r.randcnt == 0 {
+		r.isaac64()
+		r.randcnt = randSiz
+	}
+	r.randcnt--
+	return r.randrsl[r.randcnt]
+}
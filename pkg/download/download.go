@@ -0,0 +1,467 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/decrypt"
+	"wx_channel/pkg/naming"
+)
+
+// 默认的文件名，标题和 ID 都为空时使用 objectNonceId 或视频地址的哈希
+// 不使用当前时间，否则中断后再次下载时找不到之前的 .part 文件
+const DefaultTemplate = "{title|id|nonce_id|url_hash}_{spec}.mp4"
+
+const userAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+
+// 需要下载的视频
+type Media struct {
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title,omitempty"`
+	URL     string `json:"url"`
+	Key     string `json:"key,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Format  string `json:"format,omitempty"`
+	NonceID string `json:"nonce_id,omitempty"`
+	// 作者昵称和发布时间，用于生成文件名
+	Nickname   string `json:"nickname,omitempty"`
+	CreateTime int64  `json:"createtime,omitempty"`
+	// 页面提供的所有清晰度
+	Specs []Spec `json:"specs,omitempty"`
+	// 最终下载的清晰度
+	Spec *Spec `json:"spec,omitempty"`
+}
+
+type Manager struct {
+	Dir    string
+	Client *http.Client
+	// 单个文件同时使用的连接数，小于 2 时不分段
+	Connections int
+	// 没有指定清晰度时按该规则选择
+	Quality Policy
+	// 保存的文件相对于 Dir 的路径
+	Template *naming.Template
+	Queue    *Queue
+	History  *History
+	slots    chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// max_connections 是所有下载任务同时使用的连接数上限
+// 下载队列和下载记录保存在 dir 下的 queue.json 和 history.json 中
+func NewManager(dir string, connections, max_connections int) (*Manager, error) {
+	if connections < 1 {
+		connections = 1
+	}
+	if max_connections < 1 {
+		max_connections = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建下载目录失败，%v", err)
+	}
+	queue, err := OpenQueue(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取下载队列失败，%v", err)
+	}
+	history, err := OpenHistory(filepath.Join(dir, "history.json"))
+	if err != nil {
+		return nil, fmt.Errorf("读取下载记录失败，%v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		Dir:         dir,
+		Client:      &http.Client{},
+		Connections: connections,
+		Quality:     Policy{Rule: DefaultQuality},
+		Template:    naming.MustParse(DefaultTemplate),
+		Queue:       queue,
+		History:     history,
+		slots:       make(chan struct{}, max_connections),
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+// 该视频已经下载过
+var ErrDownloaded = errors.New("该视频已经下载过")
+
+// 添加到下载队列，已经下载过的视频在 force 为 false 时返回 ErrDownloaded
+func (m *Manager) Add(media Media, force bool) (*Job, error) {
+	if media.URL == "" {
+		return nil, errors.New("缺少视频地址")
+	}
+	m.chooseSpec(&media)
+	if !force {
+		if _, ok := m.History.Find(media); ok {
+			return nil, ErrDownloaded
+		}
+	}
+	return m.Queue.Push(media, force)
+}
+
+// 等待 ids 对应的任务全部完成或者放弃重试
+func (m *Manager) Wait(ids []string) {
+	for {
+		if m.Queue.settled(ids) {
+			return
+		}
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// 按清晰度规则选择要下载的清晰度，并记录到 media 中
+func (m *Manager) chooseSpec(media *Media) {
+	if media.Format != "" {
+		for i := range media.Specs {
+			if media.Specs[i].FileFormat == media.Format {
+				media.Spec = &media.Specs[i]
+			}
+		}
+		return
+	}
+	spec, ok := m.Quality.Choose(media.Specs)
+	if !ok || spec.FileFormat == "" {
+		return
+	}
+	u, err := withSpecFlag(media.URL, spec.FileFormat)
+	if err != nil {
+		slog.Warn("视频地址无效，使用默认清晰度", "url", media.URL, "error", err)
+		return
+	}
+	media.Spec = &spec
+	media.Format = spec.FileFormat
+	media.URL = u
+}
+
+// 启动 workers 个任务同时下载队列中的视频
+func (m *Manager) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.work()
+		}()
+	}
+}
+
+func (m *Manager) work() {
+	for {
+		job, wait := m.Queue.next(time.Now())
+		if job == nil {
+			var timer <-chan time.Time
+			if !wait.IsZero() {
+				timer = time.After(time.Until(wait))
+			}
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-m.Queue.notify:
+			case <-timer:
+			}
+			continue
+		}
+		// 排队期间可能已经下载过了
+		if record, ok := m.History.Find(job.Media); ok && !job.Force {
+			m.Queue.finish(job.ID, record.Path, nil)
+			slog.Info("跳过已下载的视频", "path", record.Path)
+			continue
+		}
+		file_path, err := m.Download(m.ctx, job.Media)
+		if m.ctx.Err() != nil {
+			m.Queue.requeue(job.ID)
+			return
+		}
+		if err == nil {
+			if herr := m.History.Add(job.Media, file_path); herr != nil {
+				slog.Error("保存下载记录失败", "error", herr)
+			}
+		}
+		m.Queue.finish(job.ID, file_path, err)
+		if err != nil {
+			slog.Error("下载失败", "title", job.Media.Title, "error", err)
+			continue
+		}
+		slog.Info("下载完成", "path", file_path)
+	}
+}
+
+// 停止所有下载并保存进度，下次启动时会继续
+func (m *Manager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// 占用一个连接，ctx 结束时返回错误
+func (m *Manager) acquire(ctx context.Context) error {
+	select {
+	case m.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) release() {
+	<-m.slots
+}
+
+// 下载并解密视频，返回保存的文件路径
+// 下载过程中写入 <name>.part，中断后再次下载会通过 Range 请求继续
+func (m *Manager) Download(ctx context.Context, media Media) (string, error) {
+	var key []byte
+	if media.Key != "" {
+		k, err := decrypt.Keystream(media.Key)
+		if err != nil {
+			return "", err
+		}
+		key = k
+	}
+	file_path := filepath.Join(m.Dir, m.Template.Render(media.Fields()))
+	if err := os.MkdirAll(filepath.Dir(file_path), 0755); err != nil {
+		return "", fmt.Errorf("创建下载目录失败，%v", err)
+	}
+	// 同名文件已经存在时不覆盖
+	file_path, prev := resolvePath(file_path, media)
+	part_path := file_path + ".part"
+	state := &State{ID: media.historyID(), URL: media.URL, Key: media.Key, Size: media.Size}
+	if prev != nil && state.Size == 0 {
+		state.Size = prev.Size
+	}
+	if m.Connections > 1 {
+		size, ranged, err := m.probe(ctx, media.URL)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", err
+			}
+			// 有的服务器不接受 Range 请求，使用单个连接下载
+			slog.Warn("获取视频大小失败，使用单个连接下载", "title", media.Title, "error", err)
+		}
+		if size > 0 {
+			state.Size = size
+		}
+		if err == nil && ranged && state.Size >= minSegmentSize*2 {
+			state.Segments = splitSegments(state.Size, m.Connections, prev)
+			if err := m.downloadSegments(ctx, media, key, part_path, state); err != nil {
+				return "", err
+			}
+			return m.finish(file_path, part_path)
+		}
+	}
+	if prev != nil && len(prev.Segments) == 0 {
+		state.Completed = prev.Completed
+	}
+	if err := m.downloadStream(ctx, media, key, part_path, state); err != nil {
+		return "", err
+	}
+	return m.finish(file_path, part_path)
+}
+
+// 依次尝试 name.mp4 name (1).mp4 name (2).mp4 等，找到该视频之前未完成的 .part 文件时继续下载
+// 否则使用第一个不存在的文件名，同名文件已经存在时不覆盖
+func resolvePath(file_path string, media Media) (string, *State) {
+	ext := filepath.Ext(file_path)
+	base := strings.TrimSuffix(file_path, ext)
+	for i := 0; ; i++ {
+		p := file_path
+		if i > 0 {
+			p = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		part_path := p + ".part"
+		if prev, err := loadState(part_path); err == nil && prev.matches(media) {
+			if info, err := os.Stat(part_path); err == nil && info.Size() >= prev.written() {
+				return p, prev
+			}
+		}
+		// 其他视频的 .part 文件也不能覆盖
+		if !exists(p) && !exists(part_path) {
+			return p, nil
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// 单个连接顺序下载
+func (m *Manager) downloadStream(ctx context.Context, media Media, key []byte, part_path string, state *State) error {
+	if err := m.acquire(ctx); err != nil {
+		return err
+	}
+	defer m.release()
+	req, err := http.NewRequestWithContext(ctx, "GET", media.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if state.Completed > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", state.Completed))
+	}
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求视频失败，%v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// 服务器不支持 Range，只能从头开始
+		state.Completed = 0
+		if resp.ContentLength > 0 {
+			state.Size = resp.ContentLength
+		}
+	case http.StatusPartialContent:
+		if resp.ContentLength > 0 {
+			state.Size = state.Completed + resp.ContentLength
+		}
+		slog.Info("继续下载", "title", media.Title, "completed", state.Completed)
+	case http.StatusRequestedRangeNotSatisfiable:
+		if state.Size > 0 && state.Completed == state.Size {
+			return nil
+		}
+		removeState(part_path)
+		return fmt.Errorf("请求视频失败，状态码 %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("请求视频失败，状态码 %d", resp.StatusCode)
+	}
+	f, err := os.OpenFile(part_path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("创建文件失败，%v", err)
+	}
+	// 丢弃状态文件中未记录的内容
+	if err := f.Truncate(state.Completed); err != nil {
+		f.Close()
+		return fmt.Errorf("写入文件失败，%v", err)
+	}
+	var body io.Reader = resp.Body
+	if key != nil {
+		body = decrypt.NewReaderAt(body, key, state.Completed)
+	}
+	progress := newProgress(media.Title, state.Size, state.Completed)
+	err = copyAt(f, body, state.Completed, func(n int64) error {
+		progress.add(n)
+		return state.update(part_path, func() { state.Completed += n })
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if serr := state.save(part_path); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("写入文件失败，%v", err)
+	}
+	if state.Size > 0 && state.Completed < state.Size {
+		return fmt.Errorf("下载不完整，%d/%d", state.Completed, state.Size)
+	}
+	return nil
+}
+
+func (m *Manager) finish(file_path, part_path string) (string, error) {
+	if err := os.Rename(part_path, file_path); err != nil {
+		return "", fmt.Errorf("保存文件失败，%v", err)
+	}
+	removeState(part_path)
+	return file_path, nil
+}
+
+// 从 offset 开始写入，每写入一块调用一次 written
+func copyAt(w io.WriterAt, r io.Reader, offset int64, written func(n int64) error) error {
+	buf := make([]byte, 256<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+			if werr := written(int64(n)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 生成文件名时可以使用的字段
+func (media Media) Fields() naming.Fields {
+	fields := naming.Fields{
+		"id":         media.ID,
+		"title":      media.Title,
+		"nickname":   media.Nickname,
+		"createtime": media.CreateTime,
+		"spec":       media.Format,
+		"nonce_id":   media.NonceID,
+		"url_hash":   media.urlHash(),
+		"now":        time.Now(),
+	}
+	if media.Spec != nil {
+		fields["width"] = media.Spec.Width
+		fields["height"] = media.Spec.Height
+	}
+	return fields
+}
+
+// 视频地址的哈希，地址中的 token 等参数每次可能不同，只使用 encfilekey
+func (media Media) urlHash() string {
+	key := media.URL
+	if u, err := url.Parse(media.URL); err == nil {
+		if v := u.Query().Get("encfilekey"); v != "" {
+			key = v
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// 每下载 10% 打印一次进度，多个连接共用
+type progress struct {
+	mu     sync.Mutex
+	name   string
+	total  int64
+	loaded int64
+	step   int64
+}
+
+func newProgress(name string, total, loaded int64) *progress {
+	p := &progress{name: name, total: total, loaded: loaded}
+	if total > 0 {
+		p.step = loaded * 10 / total
+	}
+	return p
+}
+
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loaded += n
+	if p.total > 0 {
+		if s := p.loaded * 10 / p.total; s > p.step {
+			p.step = s
+			slog.Info("下载进度", "title", p.name, "percent", s*10)
+		}
+	}
+}
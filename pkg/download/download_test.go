@@ -0,0 +1,74 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 标题和 ID 为空时文件名不能随时间变化
+func TestDefaultTemplateStable(t *testing.T) {
+	m := newTestManager(t, 1)
+	for _, tt := range []struct {
+		a, b Media
+		want string
+	}{
+		{
+			Media{NonceID: "123_0_0", URL: "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=1", Format: "xWT111"},
+			Media{NonceID: "123_0_0", URL: "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=2", Format: "xWT111"},
+			"123_0_0_xWT111.mp4",
+		},
+		{
+			Media{URL: "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=1"},
+			Media{URL: "https://finder.video.qq.com/251/20302/stodownload?token=2&encfilekey=abc"},
+			"",
+		},
+	} {
+		a, b := m.Template.Render(tt.a.Fields()), m.Template.Render(tt.b.Fields())
+		if a != b || (tt.want != "" && a != tt.want) {
+			t.Fatalf("文件名 %s %s，应为 %s", a, b, tt.want)
+		}
+	}
+	other := Media{URL: "https://finder.video.qq.com/251/20302/stodownload?encfilekey=def&token=1"}
+	if m.Template.Render(other.Fields()) == m.Template.Render(Media{URL: "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc"}.Fields()) {
+		t.Fatal("不同视频的文件名相同")
+	}
+}
+
+// 同名文件已经存在时，继续下载之前保存在 name (1).mp4.part 中的内容
+func TestDownloadResumeRenamed(t *testing.T) {
+	server := newVideoServer(t, 3<<20, testKey(t))
+	m := newTestManager(t, 1)
+	media := Media{NonceID: "123_0_0", URL: server.URL + "/video?token=2", Key: testSeed}
+	name := m.Template.Render(media.Fields())
+	// 另一个同名视频已经下载完成，还有一个其他视频未完成的 .part
+	if err := os.WriteFile(filepath.Join(m.Dir, name), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"456_0_0", "123_0_0"} {
+		part_path := filepath.Join(m.Dir, fmt.Sprintf("123_0_0 (%d).mp4.part", i+1))
+		if err := os.WriteFile(part_path, server.plain[:1<<20], 0644); err != nil {
+			t.Fatal(err)
+		}
+		state := &State{ID: id, URL: server.URL + "/video?token=1", Key: testSeed, Size: int64(len(server.plain)), Completed: 1 << 20}
+		if err := state.save(part_path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := m.Download(context.Background(), media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(m.Dir, "123_0_0 (2).mp4"); path != want {
+		t.Fatalf("path = %s, want %s", path, want)
+	}
+	checkFile(t, path, server.plain)
+	if len(server.ranges) != 1 || server.ranges[0] != fmt.Sprintf("bytes=%d-", 1<<20) {
+		t.Fatalf("ranges = %q", server.ranges)
+	}
+	if _, err := os.Stat(filepath.Join(m.Dir, "123_0_0 (1).mp4.part")); err != nil {
+		t.Fatal("其他视频的 .part 文件被覆盖")
+	}
+}
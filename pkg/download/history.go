@@ -0,0 +1,170 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 一次完成的下载
+type Record struct {
+	ID       string    `json:"id"`
+	Spec     string    `json:"spec,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	Nickname string    `json:"nickname,omitempty"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Time     time.Time `json:"time"`
+}
+
+// 已下载视频的索引，按视频 ID 和清晰度记录，用于跳过重复下载
+type History struct {
+	path    string
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+// 视频 ID 为空时使用 objectNonceId
+func historyKey(id, spec string) string {
+	return id + "/" + spec
+}
+
+func (media Media) historyID() string {
+	if media.ID != "" {
+		return media.ID
+	}
+	return media.NonceID
+}
+
+func OpenHistory(path string) (*History, error) {
+	h := &History{path: path, records: make(map[string]*Record)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var records []*Record
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			h.records[historyKey(r.ID, r.Spec)] = r
+		}
+	}
+	return h, nil
+}
+
+// 查找已下载的记录，文件已经被删除时视为没有下载
+func (h *History) Find(media Media) (*Record, bool) {
+	id := media.historyID()
+	if id == "" {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.records[historyKey(id, media.Format)]
+	if !ok {
+		return nil, false
+	}
+	if _, err := os.Stat(r.Path); err != nil {
+		return nil, false
+	}
+	copied := *r
+	return &copied, true
+}
+
+// 记录下载完成的文件
+func (h *History) Add(media Media, file_path string) error {
+	id := media.historyID()
+	if id == "" {
+		return nil
+	}
+	size, sum, err := checksum(file_path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[historyKey(id, media.Format)] = &Record{
+		ID:       id,
+		Spec:     media.Format,
+		Title:    media.Title,
+		Nickname: media.Nickname,
+		Path:     file_path,
+		Size:     size,
+		SHA256:   sum,
+		Time:     time.Now(),
+	}
+	return h.save()
+}
+
+// 按下载时间排序的所有记录
+func (h *History) List() []Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := make([]Record, 0, len(h.records))
+	for _, r := range h.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records
+}
+
+// 删除文件已不存在的记录，before 不为零时同时删除更早的记录，返回删除的数量
+func (h *History) Prune(before time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for key, r := range h.records {
+		_, err := os.Stat(r.Path)
+		if err != nil || (!before.IsZero() && r.Time.Before(before)) {
+			delete(h.records, key)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, h.save()
+}
+
+func (h *History) save() error {
+	records := make([]*Record, 0, len(h.records))
+	for _, r := range h.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+func checksum(file_path string) (int64, string, error) {
+	f, err := os.Open(file_path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
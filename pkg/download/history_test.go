@@ -0,0 +1,162 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.json")
+	h, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(dir, "a.mp4")
+	writeTestFile(t, a, "video a")
+	if err := h.Add(Media{ID: "1", Format: "xWT111", Title: "标题", Nickname: "作者"}, a); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := h.Find(Media{ID: "1", Format: "xWT111"})
+	sum := sha256.Sum256([]byte("video a"))
+	if !ok || r.Path != a || r.Size != 7 || r.SHA256 != hex.EncodeToString(sum[:]) || r.Title != "标题" || r.Nickname != "作者" {
+		t.Fatalf("record = %+v", r)
+	}
+	// 按 ID 和清晰度区分
+	if _, ok := h.Find(Media{ID: "1", Format: "xWT112"}); ok {
+		t.Fatal("不同清晰度不应该视为已下载")
+	}
+	if _, ok := h.Find(Media{ID: "2", Format: "xWT111"}); ok {
+		t.Fatal("不同视频不应该视为已下载")
+	}
+	// 没有 ID 时使用 objectNonceId，都没有时不记录
+	b := filepath.Join(dir, "b.mp4")
+	writeTestFile(t, b, "video b")
+	if err := h.Add(Media{NonceID: "123_0_0"}, b); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := h.Find(Media{NonceID: "123_0_0"}); !ok || r.ID != "123_0_0" || r.Spec != "" {
+		t.Fatalf("record = %+v", r)
+	}
+	if err := h.Add(Media{}, b); err != nil || len(h.List()) != 2 {
+		t.Fatalf("没有 ID 的视频 %v %d", err, len(h.List()))
+	}
+	if _, ok := h.Find(Media{}); ok {
+		t.Fatal("没有 ID 的视频不应该视为已下载")
+	}
+	if err := h.Add(Media{ID: "3"}, filepath.Join(dir, "missing.mp4")); err == nil {
+		t.Fatal("文件不存在时应返回错误")
+	}
+
+	// 文件被删除后视为没有下载
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.Find(Media{NonceID: "123_0_0"}); ok {
+		t.Fatal("文件已被删除")
+	}
+
+	// 重新打开时读取保存的记录
+	h, err = OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := h.List(); len(list) != 2 || list[0].ID != "1" || list[1].ID != "123_0_0" {
+		t.Fatalf("list = %+v", list)
+	}
+	if r, ok := h.Find(Media{ID: "1", Format: "xWT111"}); !ok || r.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("重新打开之后 record = %+v", r)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.json")
+	h, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"old", "new", "deleted"} {
+		file_path := filepath.Join(dir, id+".mp4")
+		writeTestFile(t, file_path, id)
+		if err := h.Add(Media{ID: id}, file_path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.records[historyKey("old", "")].Time = time.Now().Add(-48 * time.Hour)
+	os.Remove(filepath.Join(dir, "deleted.mp4"))
+
+	// 只删除文件不存在的记录
+	if n, err := h.Prune(time.Time{}); n != 1 || err != nil {
+		t.Fatalf("Prune 删除了 %d 条，%v", n, err)
+	}
+	if n, err := h.Prune(time.Now().Add(-24 * time.Hour)); n != 1 || err != nil {
+		t.Fatalf("Prune 删除了 %d 条，%v", n, err)
+	}
+	if n, err := h.Prune(time.Now().Add(-24 * time.Hour)); n != 0 || err != nil {
+		t.Fatalf("Prune 删除了 %d 条，%v", n, err)
+	}
+	h, err = OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := h.List(); len(list) != 1 || list[0].ID != "new" {
+		t.Fatalf("重新打开之后 list = %+v", list)
+	}
+}
+
+// 已经下载过的视频不再下载，force 时重新下载
+func TestManagerSkipDownloaded(t *testing.T) {
+	server := newVideoServer(t, 1<<10, nil)
+	m := newTestManager(t, 1)
+	m.Start(1)
+	defer m.Close()
+	media := Media{ID: "1", Title: "video", URL: server.URL + "/video"}
+	download := func(force bool) *Job {
+		t.Helper()
+		job, err := m.Add(media, force)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Wait([]string{job.ID})
+		return job
+	}
+	requests := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.ranges)
+	}
+
+	download(false)
+	if _, ok := m.History.Find(media); !ok || requests() != 1 {
+		t.Fatalf("下载之后没有记录，请求了 %d 次", requests())
+	}
+	if _, err := m.Add(media, false); !errors.Is(err, ErrDownloaded) {
+		t.Fatalf("err = %v，应为 ErrDownloaded", err)
+	}
+	// 加入队列之后才下载完成的，下载时跳过
+	job, err := m.Queue.Push(media, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Wait([]string{job.ID})
+	if requests() != 1 {
+		t.Fatalf("已下载的视频又请求了 %d 次", requests()-1)
+	}
+	download(true)
+	if requests() != 2 {
+		t.Fatal("force 时没有重新下载")
+	}
+}
@@ -0,0 +1,286 @@
+package download
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// 相同的视频已经在队列中
+var ErrQueued = errors.New("该视频已在下载队列中")
+
+// 失败后最多重试的次数
+const MaxRetries = 5
+
+// 第一次重试前等待的时间，之后每次翻倍
+const retryDelay = 10 * time.Second
+const maxRetryDelay = 30 * time.Minute
+
+type Job struct {
+	ID        string    `json:"id"`
+	Media     Media     `json:"media"`
+	Status    JobStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Retries   int       `json:"retries"`
+	NextRetry time.Time `json:"next_retry,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// 忽略下载记录重新下载
+	Force bool `json:"force,omitempty"`
+}
+
+// 保存在磁盘上的下载队列，程序重启后会继续未完成的任务
+// 下载完成的任务会从队列中删除，下载记录保存在 History 中
+type Queue struct {
+	path   string
+	mu     sync.Mutex
+	jobs   []*Job
+	notify chan struct{}
+	// 每次修改后加一，写入文件时不持有 mu，旧的内容不能覆盖新的
+	version uint64
+	save_mu sync.Mutex
+	saved   uint64
+}
+
+// 修改任务后需要保存的内容
+type queueSnapshot struct {
+	version uint64
+	jobs    []Job
+}
+
+func OpenQueue(path string) (*Queue, error) {
+	q := &Queue{path: path, notify: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var jobs []*Job
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, err
+		}
+	}
+	for _, job := range jobs {
+		// 之前的版本会保留已经完成的任务
+		if job.Status == JobDone {
+			continue
+		}
+		// 上次退出时正在下载的任务重新排队
+		if job.Status == JobRunning {
+			job.Status = JobPending
+		}
+		q.jobs = append(q.jobs, job)
+	}
+	return q, nil
+}
+
+// 添加任务，相同的视频还没有下载完成时不会重复添加
+func (q *Queue) Push(media Media, force bool) (*Job, error) {
+	q.mu.Lock()
+	for _, job := range q.jobs {
+		if job.Media.URL == media.URL || (media.ID != "" && job.Media.ID == media.ID && job.Media.Format == media.Format) {
+			if job.Status == JobFailed && job.Retries >= MaxRetries {
+				// 已经放弃的任务重新开始
+				job.Status = JobPending
+				job.Retries = 0
+				job.Error = ""
+				job.Media = media
+				job.Force = force
+				snapshot := q.snapshot()
+				copied := *job
+				q.mu.Unlock()
+				q.wake()
+				return &copied, q.save(snapshot)
+			}
+			q.mu.Unlock()
+			return nil, ErrQueued
+		}
+	}
+	now := time.Now()
+	job := &Job{
+		ID:        newJobID(),
+		Media:     media,
+		Status:    JobPending,
+		Force:     force,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	q.jobs = append(q.jobs, job)
+	snapshot := q.snapshot()
+	copied := *job
+	q.mu.Unlock()
+	if err := q.save(snapshot); err != nil {
+		return nil, err
+	}
+	q.wake()
+	return &copied, nil
+}
+
+// 所有未完成任务的副本
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.copyJobs()
+}
+
+// 任务是否都已经完成或者放弃重试，完成的任务已经不在队列中
+func (q *Queue) settled(ids []string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		for _, id := range ids {
+			if job.ID != id {
+				continue
+			}
+			if !(job.Status == JobFailed && job.Retries >= MaxRetries) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 取出一个可以开始的任务，没有时返回 nil 和下一个任务可以重试的时间
+func (q *Queue) next(now time.Time) (*Job, time.Time) {
+	q.mu.Lock()
+	var wait time.Time
+	for _, job := range q.jobs {
+		ready := job.Status == JobPending
+		if job.Status == JobFailed && job.Retries < MaxRetries {
+			if job.NextRetry.After(now) {
+				if wait.IsZero() || job.NextRetry.Before(wait) {
+					wait = job.NextRetry
+				}
+				continue
+			}
+			ready = true
+		}
+		if ready {
+			job.Status = JobRunning
+			job.UpdatedAt = now
+			snapshot := q.snapshot()
+			copied := *job
+			q.mu.Unlock()
+			q.save(snapshot)
+			return &copied, time.Time{}
+		}
+	}
+	q.mu.Unlock()
+	return nil, wait
+}
+
+// 更新任务的结果，err 为空表示下载完成，完成的任务从队列中删除
+func (q *Queue) finish(id string, file_path string, err error) {
+	q.mu.Lock()
+	for i, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+		if err == nil {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+		} else {
+			job.UpdatedAt = time.Now()
+			job.Status = JobFailed
+			job.Error = err.Error()
+			job.Retries++
+			job.NextRetry = job.UpdatedAt.Add(backoff(job.Retries))
+		}
+		snapshot := q.snapshot()
+		q.mu.Unlock()
+		q.save(snapshot)
+		q.wake()
+		return
+	}
+	q.mu.Unlock()
+}
+
+// 程序退出导致的中断不算失败
+func (q *Queue) requeue(id string) {
+	q.mu.Lock()
+	for _, job := range q.jobs {
+		if job.ID == id {
+			job.Status = JobPending
+			job.UpdatedAt = time.Now()
+			snapshot := q.snapshot()
+			q.mu.Unlock()
+			q.save(snapshot)
+			return
+		}
+	}
+	q.mu.Unlock()
+}
+
+func (q *Queue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 调用时需要持有 q.mu
+func (q *Queue) copyJobs() []Job {
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// 调用时需要持有 q.mu
+func (q *Queue) snapshot() queueSnapshot {
+	q.version++
+	return queueSnapshot{version: q.version, jobs: q.copyJobs()}
+}
+
+// 不持有 q.mu，写入较慢时不影响其他任务，已经保存了更新的内容时跳过
+func (q *Queue) save(snapshot queueSnapshot) error {
+	q.save_mu.Lock()
+	defer q.save_mu.Unlock()
+	if snapshot.version <= q.saved {
+		return nil
+	}
+	data, err := json.MarshalIndent(snapshot.jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	q.saved = snapshot.version
+	return nil
+}
+
+func backoff(retries int) time.Duration {
+	d := retryDelay
+	for i := 1; i < retries; i++ {
+		d *= 2
+		if d >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return d
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
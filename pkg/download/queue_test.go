@@ -0,0 +1,113 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readQueueFile(t *testing.T, path string) []Job {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestQueueDropsDoneJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := q.Push(Media{ID: "1", URL: "https://example.com/1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := q.Push(Media{ID: "2", URL: "https://example.com/2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Push(Media{ID: "1", URL: "https://example.com/1"}, false); err != ErrQueued {
+		t.Fatalf("err = %v, want ErrQueued", err)
+	}
+	q.next(time.Now())
+	q.finish(a.ID, "1.mp4", nil)
+	if jobs := readQueueFile(t, path); len(jobs) != 1 || jobs[0].ID != b.ID {
+		t.Fatalf("queue.json = %+v", jobs)
+	}
+	if !q.settled([]string{a.ID}) || q.settled([]string{a.ID, b.ID}) {
+		t.Fatal("settled 结果错误")
+	}
+	// 完成之后可以再次添加
+	if _, err := q.Push(Media{ID: "1", URL: "https://example.com/1"}, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 之前的版本保存的 done 任务在读取时删除，running 的任务重新排队
+func TestOpenQueueLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	data, _ := json.Marshal([]Job{
+		{ID: "a", Status: JobDone},
+		{ID: "b", Status: JobRunning},
+		{ID: "c", Status: JobFailed, Retries: 1},
+	})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := q.Jobs()
+	if len(jobs) != 2 || jobs[0].ID != "b" || jobs[0].Status != JobPending || jobs[1].ID != "c" {
+		t.Fatalf("jobs = %+v", jobs)
+	}
+}
+
+// 并发修改时文件中保存的是最后的状态
+func TestQueueConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := OpenQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			job, err := q.Push(Media{URL: fmt.Sprintf("https://example.com/%d", i)}, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var result error
+			if i%2 == 0 {
+				result = errors.New("下载失败")
+			}
+			q.finish(job.ID, "", result)
+		}(i)
+	}
+	wg.Wait()
+	jobs := readQueueFile(t, path)
+	if len(jobs) != 25 || len(q.Jobs()) != 25 {
+		t.Fatalf("queue.json 中有 %d 个任务，队列中有 %d 个", len(jobs), len(q.Jobs()))
+	}
+	for _, job := range jobs {
+		if job.Status != JobFailed || job.Retries != 1 {
+			t.Fatalf("job = %+v", job)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"wx_channel/pkg/decrypt"
+)
+
+// 小于该大小的分段不值得单独建立连接
+const minSegmentSize = 2 << 20
+
+// 文件中的一段，End 包含在内
+type Segment struct {
+	Start     int64 `json:"start"`
+	End       int64 `json:"end"`
+	Completed int64 `json:"completed"`
+}
+
+func (s Segment) done() bool {
+	return s.Start+s.Completed > s.End
+}
+
+// 将文件平均分成 n 段，prev 中已经下载的部分会保留
+func splitSegments(size int64, n int, prev *State) []Segment {
+	if prev != nil && len(prev.Segments) > 0 && prev.Size == size {
+		return prev.Segments
+	}
+	if max := int(size / minSegmentSize); n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	var segments []Segment
+	chunk := size / int64(n)
+	for i := 0; i < n; i++ {
+		seg := Segment{Start: int64(i) * chunk, End: int64(i+1)*chunk - 1}
+		if i == n-1 {
+			seg.End = size - 1
+		}
+		segments = append(segments, seg)
+	}
+	// 之前单连接下载的内容是从头开始连续的
+	if prev != nil && len(prev.Segments) == 0 && prev.Completed > 0 {
+		for i := range segments {
+			seg := &segments[i]
+			if prev.Completed > seg.End {
+				seg.Completed = seg.End - seg.Start + 1
+			} else if prev.Completed > seg.Start {
+				seg.Completed = prev.Completed - seg.Start
+			}
+		}
+	}
+	return segments
+}
+
+// 通过请求第一个字节判断服务器是否支持 Range 并获取文件大小
+func (m *Manager) probe(ctx context.Context, url string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("请求视频失败，%v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/12345
+		content_range := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(content_range, "/"); i != -1 {
+			size, err := strconv.ParseInt(content_range[i+1:], 10, 64)
+			if err == nil {
+				return size, true, nil
+			}
+		}
+		return 0, false, nil
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.ContentLength, false, nil
+	}
+	return 0, false, fmt.Errorf("请求视频失败，状态码 %d", resp.StatusCode)
+}
+
+// 多个连接同时下载各个分段，直接写入 .part 文件中对应的位置
+func (m *Manager) downloadSegments(ctx context.Context, media Media, key []byte, part_path string, state *State) error {
+	f, err := os.OpenFile(part_path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("创建文件失败，%v", err)
+	}
+	if err := f.Truncate(state.Size); err != nil {
+		f.Close()
+		return fmt.Errorf("写入文件失败，%v", err)
+	}
+	if state.written() > 0 {
+		slog.Info("继续下载", "title", media.Title, "completed", state.written())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	progress := newProgress(media.Title, state.Size, state.written())
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first_err error
+	for i := range state.Segments {
+		if state.Segments[i].done() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := m.downloadSegment(ctx, media.URL, key, f, part_path, state, i, progress)
+			if err != nil {
+				once.Do(func() {
+					first_err = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	err = first_err
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if serr := state.save(part_path); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("下载失败，%v", err)
+	}
+	return nil
+}
+
+func (m *Manager) downloadSegment(ctx context.Context, url string, key []byte, f *os.File, part_path string, state *State, i int, progress *progress) error {
+	if err := m.acquire(ctx); err != nil {
+		return err
+	}
+	defer m.release()
+	state.mu.Lock()
+	seg := state.Segments[i]
+	state.mu.Unlock()
+	offset := seg.Start + seg.Completed
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End))
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求视频失败，%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("请求视频失败，状态码 %d", resp.StatusCode)
+	}
+	var body io.Reader = io.LimitReader(resp.Body, seg.End-offset+1)
+	if key != nil {
+		// 只有开头的分段需要解密
+		body = decrypt.NewReaderAt(body, key, offset)
+	}
+	err = copyAt(f, body, offset, func(n int64) error {
+		progress.add(n)
+		return state.update(part_path, func() { state.Segments[i].Completed += n })
+	})
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	done := state.Segments[i].done()
+	state.mu.Unlock()
+	if !done {
+		return fmt.Errorf("分段下载不完整，%d-%d", seg.Start, seg.End)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wx_channel/pkg/decrypt"
+)
+
+const testSeed = "2136343393"
+
+func TestMain(m *testing.M) {
+	// 不输出下载进度
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// 支持 Range 的视频服务器，返回开头加密后的内容
+type videoServer struct {
+	*httptest.Server
+	plain []byte
+	mu    sync.Mutex
+	// 除了 bytes=0-0 之外的请求的 Range
+	ranges []string
+	// 为 true 时拒绝 bytes=0-0
+	reject_probe bool
+	// 每个连接每写入 64KiB 等待的时间，用于模拟带宽限制
+	delay time.Duration
+}
+
+func newVideoServer(tb testing.TB, size int, key []byte) *videoServer {
+	tb.Helper()
+	plain := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(plain)
+	encrypted := append([]byte(nil), plain...)
+	if key != nil {
+		decrypt.XOR(encrypted, key, 0)
+	}
+	s := &videoServer{plain: plain}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=0-0" {
+			if s.reject_probe {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		} else {
+			s.mu.Lock()
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+			s.mu.Unlock()
+		}
+		var out http.ResponseWriter = w
+		if s.delay > 0 {
+			out = throttled{w, s.delay}
+		}
+		http.ServeContent(out, r, "video.mp4", time.Time{}, bytes.NewReader(encrypted))
+	}))
+	tb.Cleanup(s.Close)
+	return s
+}
+
+type throttled struct {
+	http.ResponseWriter
+	delay time.Duration
+}
+
+func (t throttled) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), 64<<10)
+		time.Sleep(t.delay)
+		if _, err := t.ResponseWriter.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func newTestManager(tb testing.TB, connections int) *Manager {
+	tb.Helper()
+	m, err := NewManager(tb.TempDir(), connections, 8)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+func testKey(tb testing.TB) []byte {
+	tb.Helper()
+	key, err := decrypt.Keystream(testSeed)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return key
+}
+
+func checkFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		for i := range want {
+			if i >= len(got) || got[i] != want[i] {
+				t.Fatalf("第 %d 字节开始不一致，文件大小 %d，应为 %d", i, len(got), len(want))
+			}
+		}
+		t.Fatalf("文件大小 %d，应为 %d", len(got), len(want))
+	}
+}
+
+func TestDownloadSegments(t *testing.T) {
+	server := newVideoServer(t, 9<<20+12345, testKey(t))
+	m := newTestManager(t, 4)
+	path, err := m.Download(context.Background(), Media{ID: "1", Title: "video", URL: server.URL + "/video?a=1", Key: testSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, server.plain)
+	if len(server.ranges) != 4 {
+		t.Fatalf("ranges = %q, want 4 segments", server.ranges)
+	}
+	if _, err := os.Stat(statePath(path + ".part")); !os.IsNotExist(err) {
+		t.Fatalf("状态文件没有删除，%v", err)
+	}
+}
+
+// 加密的前 131072 字节跨越多个分段，其中一个分段已经下载了一部分
+func TestDownloadSegmentsDecryptAcrossBoundary(t *testing.T) {
+	key := testKey(t)
+	if len(key) != 131072 {
+		t.Fatalf("len(key) = %d", len(key))
+	}
+	server := newVideoServer(t, 1<<20, key)
+	m := newTestManager(t, 4)
+	part_path := filepath.Join(m.Dir, "video.mp4.part")
+	// 第一个分段已经下载了 40000 字节，文件中是解密后的内容
+	if err := os.WriteFile(part_path, server.plain[:40000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := &State{
+		ID:   "1",
+		Key:  testSeed,
+		Size: int64(len(server.plain)),
+		Segments: []Segment{
+			{Start: 0, End: 99999, Completed: 40000},
+			{Start: 100000, End: 130000},
+			{Start: 130001, End: 131072},
+			{Start: 131073, End: int64(len(server.plain)) - 1},
+		},
+	}
+	media := Media{ID: "1", Title: "video", URL: server.URL + "/video", Key: testSeed}
+	if err := m.downloadSegments(context.Background(), media, key, part_path, state); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, part_path, server.plain)
+	want := []string{"bytes=40000-99999", "bytes=100000-130000", "bytes=130001-131072", fmt.Sprintf("bytes=131073-%d", len(server.plain)-1)}
+	for _, r := range want {
+		if !strings.Contains(strings.Join(server.ranges, " "), r) {
+			t.Fatalf("ranges = %q, want %s", server.ranges, r)
+		}
+	}
+}
+
+// 服务器不接受 bytes=0-0 时使用单个连接下载
+func TestDownloadProbeFallback(t *testing.T) {
+	server := newVideoServer(t, 5<<20, testKey(t))
+	server.reject_probe = true
+	m := newTestManager(t, 4)
+	path, err := m.Download(context.Background(), Media{ID: "1", Title: "video", URL: server.URL + "/video", Key: testSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, server.plain)
+	if len(server.ranges) != 1 || server.ranges[0] != "" {
+		t.Fatalf("ranges = %q, want one full request", server.ranges)
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	segments := splitSegments(10<<20+1, 4, &State{Completed: 3 << 20})
+	if len(segments) != 4 || segments[3].End != 10<<20 {
+		t.Fatalf("segments = %+v", segments)
+	}
+	// 之前单连接下载的 3MiB 分配到前两个分段
+	if segments[0].Completed != segments[0].End+1 || segments[1].Completed != 3<<20-segments[1].Start || segments[2].Completed != 0 {
+		t.Fatalf("segments = %+v", segments)
+	}
+	// 太小的文件不分段
+	if segments := splitSegments(3<<20, 4, nil); len(segments) != 1 {
+		t.Fatalf("segments = %+v", segments)
+	}
+}
+
+// 每个连接每写入 64KiB 等待 1ms 模拟带宽限制，比较单连接和多连接下载 32MiB 的耗时
+func BenchmarkDownload(b *testing.B) {
+	server := newVideoServer(b, 32<<20, testKey(b))
+	server.delay = time.Millisecond
+	for _, connections := range []int{1, 4} {
+		b.Run(fmt.Sprintf("connections=%d", connections), func(b *testing.B) {
+			b.SetBytes(int64(len(server.plain)))
+			for i := 0; i < b.N; i++ {
+				m := newTestManager(b, connections)
+				if _, err := m.Download(context.Background(), Media{ID: "1", Title: "video", URL: server.URL + "/video", Key: testSeed}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
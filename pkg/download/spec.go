@@ -0,0 +1,148 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 视频的一种清晰度，字段和页面中 media.spec 相同
+type Spec struct {
+	FileFormat string `json:"fileFormat"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Bitrate    int    `json:"bitRate,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+// 竖屏视频的高大于宽，按短边判断 720p 等清晰度
+func (s Spec) resolution() int {
+	if s.Width > 0 && s.Width < s.Height {
+		return s.Width
+	}
+	return s.Height
+}
+
+// 同一个视频的各个清晰度时长相同，所有清晰度都有码率时按码率比较文件大小
+// 否则都按分辨率比较，不能混用两种标准
+func smallest(specs []Spec) int {
+	by_bitrate := true
+	for _, s := range specs {
+		if s.Bitrate <= 0 {
+			by_bitrate = false
+		}
+	}
+	size := func(s Spec) int64 {
+		if by_bitrate {
+			return int64(s.Bitrate)
+		}
+		return int64(s.Width) * int64(s.Height)
+	}
+	best := 0
+	for i, s := range specs {
+		if size(s) < size(specs[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// 没有指定 --quality 时的清晰度规则
+const DefaultQuality = "highest"
+
+// 清晰度选择规则，默认为 highest
+//
+//	first     使用页面给出的第一个
+//	highest   分辨率最高的
+//	smallest  文件最小的
+//	max:720   不超过 720p 中分辨率最高的，都超过时选最小的
+type Policy struct {
+	Rule      string
+	MaxHeight int
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		s = DefaultQuality
+	}
+	switch s {
+	case "first", "highest", "smallest":
+		return Policy{Rule: s}, nil
+	}
+	if strings.HasPrefix(s, "max:") {
+		h, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, "max:"), "p"))
+		if err != nil || h <= 0 {
+			return Policy{}, fmt.Errorf("无效的清晰度规则 %s", s)
+		}
+		return Policy{Rule: "max", MaxHeight: h}, nil
+	}
+	return Policy{}, fmt.Errorf("无效的清晰度规则 %s", s)
+}
+
+func (p Policy) String() string {
+	if p.Rule == "max" {
+		return fmt.Sprintf("max:%d", p.MaxHeight)
+	}
+	return p.Rule
+}
+
+// 从 specs 中选出一个，specs 为空时返回 false
+func (p Policy) Choose(specs []Spec) (Spec, bool) {
+	if len(specs) == 0 {
+		return Spec{}, false
+	}
+	best := 0
+	switch p.Rule {
+	case "highest":
+		for i, s := range specs {
+			if better(s, specs[best]) {
+				best = i
+			}
+		}
+	case "smallest":
+		best = smallest(specs)
+	case "max":
+		best = -1
+		for i, s := range specs {
+			if s.resolution() > p.MaxHeight {
+				continue
+			}
+			if best == -1 || better(s, specs[best]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			best = smallest(specs)
+		}
+	}
+	return specs[best], true
+}
+
+// 在视频地址中设置 X-snsvideoflag 指定清晰度，已经有该参数时替换
+// 其他参数保持原样，不重新编码
+func withSpecFlag(raw, format string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" || strings.SplitN(param, "=", 2)[0] == "X-snsvideoflag" {
+			continue
+		}
+		params = append(params, param)
+	}
+	params = append(params, "X-snsvideoflag="+url.QueryEscape(format))
+	u.RawQuery = strings.Join(params, "&")
+	return u.String(), nil
+}
+
+// 分辨率相同时码率高的更好
+func better(a, b Spec) bool {
+	if a.resolution() != b.resolution() {
+		return a.resolution() > b.resolution()
+	}
+	return a.Bitrate > b.Bitrate
+}
@@ -0,0 +1,78 @@
+package download
+
+import "testing"
+
+func TestPolicyChoose(t *testing.T) {
+	specs := []Spec{
+		{FileFormat: "xWT111", Width: 1080, Height: 1920, Bitrate: 3000},
+		{FileFormat: "xWT112", Width: 720, Height: 1280, Bitrate: 1500},
+		{FileFormat: "xWT113", Width: 720, Height: 1280, Bitrate: 1800},
+		{FileFormat: "xWT114", Width: 480, Height: 854, Bitrate: 800},
+	}
+	// 有一个清晰度没有码率时全部按分辨率比较
+	no_bitrate := []Spec{
+		{FileFormat: "a", Width: 720, Height: 1280, Bitrate: 100},
+		{FileFormat: "b", Width: 480, Height: 854},
+		{FileFormat: "c", Width: 1080, Height: 1920, Bitrate: 50},
+	}
+	for _, tt := range []struct {
+		policy string
+		specs  []Spec
+		want   string
+	}{
+		{"", specs, "xWT111"},
+		{"first", specs, "xWT111"},
+		{"highest", specs, "xWT111"},
+		{"smallest", specs, "xWT114"},
+		{"max:720", specs, "xWT113"},
+		{"max:720p", specs, "xWT113"},
+		{"max:360", specs, "xWT114"},
+		{"first", no_bitrate, "a"},
+		{"highest", no_bitrate, "c"},
+		{"smallest", no_bitrate, "b"},
+		{"max:360", no_bitrate, "b"},
+	} {
+		p, err := ParsePolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := p.Choose(tt.specs)
+		if !ok || got.FileFormat != tt.want {
+			t.Errorf("%q 选择了 %s，应为 %s", tt.policy, got.FileFormat, tt.want)
+		}
+	}
+	if _, ok := (Policy{Rule: DefaultQuality}).Choose(nil); ok {
+		t.Fatal("没有清晰度时应返回 false")
+	}
+	if _, err := ParsePolicy("max:abc"); err == nil {
+		t.Fatal("max:abc 应该返回错误")
+	}
+}
+
+func TestWithSpecFlag(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"https://finder.video.qq.com/stodownload", "https://finder.video.qq.com/stodownload?X-snsvideoflag=xWT111"},
+		{"https://finder.video.qq.com/stodownload?encfilekey=a%2Bb*c&token=1", "https://finder.video.qq.com/stodownload?encfilekey=a%2Bb*c&token=1&X-snsvideoflag=xWT111"},
+		{"https://finder.video.qq.com/stodownload?X-snsvideoflag=xWT112&token=1", "https://finder.video.qq.com/stodownload?token=1&X-snsvideoflag=xWT111"},
+	} {
+		got, err := withSpecFlag(tt.url, "xWT111")
+		if err != nil || got != tt.want {
+			t.Errorf("withSpecFlag(%s) = %s，应为 %s，%v", tt.url, got, tt.want, err)
+		}
+	}
+}
+
+func TestManagerDefaultQuality(t *testing.T) {
+	m := newTestManager(t, 1)
+	media := Media{URL: "https://finder.video.qq.com/stodownload?token=1", Specs: []Spec{
+		{FileFormat: "xWT112", Width: 720, Height: 1280},
+		{FileFormat: "xWT111", Width: 1080, Height: 1920},
+	}}
+	m.chooseSpec(&media)
+	if media.Format != "xWT111" || media.URL != "https://finder.video.qq.com/stodownload?token=1&X-snsvideoflag=xWT111" {
+		t.Fatalf("format = %s, url = %s", media.Format, media.URL)
+	}
+}
@@ -0,0 +1,99 @@
+package download
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// 每写入 stateInterval 字节保存一次状态
+const stateInterval = 4 << 20
+
+// 未完成下载的状态，和 .part 文件放在一起
+type State struct {
+	ID        string `json:"id,omitempty"`
+	URL       string `json:"url"`
+	Key       string `json:"key,omitempty"`
+	Size      int64  `json:"size"`
+	Completed int64  `json:"completed"`
+	// 分段下载时各段的进度，此时不使用 Completed
+	Segments []Segment `json:"segments,omitempty"`
+
+	mu      sync.Mutex
+	file_mu sync.Mutex
+	unsaved int64
+}
+
+func statePath(part_path string) string {
+	return part_path + ".json"
+}
+
+func loadState(part_path string) (*State, error) {
+	data, err := os.ReadFile(statePath(part_path))
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func removeState(part_path string) {
+	os.Remove(statePath(part_path))
+}
+
+// 视频地址中的参数会过期，有 ID 或 objectNonceId 时优先按它判断是否同一个视频
+func (s *State) matches(media Media) bool {
+	if s.Key != media.Key {
+		return false
+	}
+	if id := media.historyID(); s.ID != "" && id != "" {
+		return s.ID == id
+	}
+	return s.URL == media.URL
+}
+
+// 已经写入 .part 文件的字节数
+func (s *State) written() int64 {
+	if len(s.Segments) == 0 {
+		return s.Completed
+	}
+	var n int64
+	for _, seg := range s.Segments {
+		n += seg.Completed
+	}
+	return n
+}
+
+// 在写入数据之后调用，状态中记录的大小不会超过实际写入的大小
+func (s *State) update(part_path string, fn func()) error {
+	s.mu.Lock()
+	before := s.written()
+	fn()
+	s.unsaved += s.written() - before
+	if s.unsaved < stateInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.unsaved = 0
+	s.mu.Unlock()
+	return s.save(part_path)
+}
+
+func (s *State) save(part_path string) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.file_mu.Lock()
+	defer s.file_mu.Unlock()
+	tmp := statePath(part_path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath(part_path))
+}
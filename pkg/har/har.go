@@ -0,0 +1,136 @@
+package har
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 格式，见 http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string   `json:"version"`
+	Creator Creator  `json:"creator"`
+	Pages   []any    `json:"pages"`
+	Entries []*Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// 毫秒
+	Time     float64  `json:"time"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+	Cache    struct{} `json:"cache"`
+	Timings  Timings  `json:"timings"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	// 二进制内容使用 base64
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// 隐藏的请求头的值
+const Redacted = "[REDACTED]"
+
+func headers(h http.Header, redact map[string]bool) []NameValue {
+	list := []NameValue{}
+	for name, values := range h {
+		// SunnyNet 和代理内部使用的请求头
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		for _, v := range values {
+			if redact[strings.ToLower(name)] {
+				v = Redacted
+			}
+			list = append(list, NameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+func queryString(u *url.URL) []NameValue {
+	list := []NameValue{}
+	for name, values := range u.Query() {
+		for _, v := range values {
+			list = append(list, NameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+// 超过 max 字节的内容不记录，文本原样保存，其余使用 base64
+func body(data []byte, max int) (text string, encoding string, comment string) {
+	if len(data) == 0 {
+		return "", "", ""
+	}
+	if max > 0 && len(data) > max {
+		return "", "", "内容超过记录上限，没有保存"
+	}
+	if utf8.Valid(data) {
+		return string(data), "", ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64", ""
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
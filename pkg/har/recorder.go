@@ -0,0 +1,284 @@
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/naming"
+)
+
+// 默认隐藏的请求头和响应头，X-Wx-Channels-Token 是页面调用本程序接口时使用的令牌
+var DefaultRedact = []string{"Cookie", "Set-Cookie", "Authorization", "Proxy-Authorization", "X-Wx-Channels-Token"}
+
+// 默认每个请求体和响应体最多记录 1MiB
+const DefaultMaxBody = 1 << 20
+
+// 请求没有响应时，超过该时间后丢弃
+const pendingTimeout = 5 * time.Minute
+
+type Options struct {
+	// 保存 HAR 文件的目录，每天一个文件
+	Dir string
+	// 需要记录的域名，.example.com 匹配子域名，为空时记录所有域名
+	Hosts []string
+	// 请求体和响应体的最大字节数，超过时只记录大小
+	MaxBody int
+	// 需要隐藏值的请求头和响应头，会加上 DefaultRedact
+	Redact []string
+	// 写入 HAR 文件的 creator.version
+	Version string
+}
+
+type pending struct {
+	entry   *Entry
+	started time.Time
+}
+
+// 记录拦截到的请求，按请求 ID 把请求阶段和响应阶段合并为一条记录
+// 为 nil 时不记录
+type Recorder struct {
+	opts    Options
+	redact  map[string]bool
+	mu      sync.Mutex
+	pending map[uint64]*pending
+	day     string
+	path    string
+	file    *os.File
+	empty   bool
+}
+
+// 文件以 footer 结尾，追加记录时覆盖 footer 后重新写入
+const footer = "\n]}}\n"
+
+func NewRecorder(opts Options) (*Recorder, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if opts.MaxBody == 0 {
+		opts.MaxBody = DefaultMaxBody
+	}
+	r := &Recorder{opts: opts, redact: make(map[string]bool), pending: make(map[uint64]*pending)}
+	for _, name := range append(append([]string{}, DefaultRedact...), opts.Redact...) {
+		r.redact[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return r, nil
+}
+
+// 该域名的请求是否需要记录
+func (r *Recorder) Match(host string) bool {
+	if r == nil {
+		return false
+	}
+	if len(r.opts.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, rule := range r.opts.Hosts {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if host == rule || (strings.HasPrefix(rule, ".") && (host == rule[1:] || strings.HasSuffix(host, rule))) {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前写入的文件
+func (r *Recorder) Path() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+func (r *Recorder) newRequest(req *http.Request, data []byte) Request {
+	request := Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []NameValue{},
+		Headers:     headers(req.Header, r.redact),
+		QueryString: queryString(req.URL),
+		HeadersSize: -1,
+		BodySize:    len(data),
+	}
+	if req.Proto != "" {
+		request.HTTPVersion = req.Proto
+	}
+	if len(data) > 0 {
+		text, encoding, comment := body(data, r.opts.MaxBody)
+		if encoding != "" {
+			// postData 没有 encoding 字段
+			text, comment = "", "二进制内容，没有保存"
+		}
+		request.PostData = &PostData{MimeType: req.Header.Get("Content-Type"), Text: text, Comment: comment}
+	}
+	return request
+}
+
+// 请求阶段调用，data 为请求体，需要在修改请求之前调用
+func (r *Recorder) Request(id uint64, req *http.Request, data []byte) {
+	if !r.Match(req.URL.Hostname()) || id == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &Entry{StartedDateTime: now, Request: r.newRequest(req, data)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, p := range r.pending {
+		if now.Sub(p.started) > pendingTimeout {
+			delete(r.pending, key)
+		}
+	}
+	r.pending[id] = &pending{entry: entry, started: now}
+}
+
+// 响应阶段调用，size 为服务器返回的原始长度，data 为解压后的响应体
+// 请求阶段没有记录时使用响应阶段的请求
+func (r *Recorder) Response(id uint64, req *http.Request, req_data []byte, resp *http.Response, size int, data []byte) error {
+	if !r.Match(req.URL.Hostname()) {
+		return nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	p, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if !ok {
+		p = &pending{entry: &Entry{StartedDateTime: now, Request: r.newRequest(req, req_data)}, started: now}
+	}
+	entry := p.entry
+	text, encoding, comment := body(data, r.opts.MaxBody)
+	entry.Response = Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []NameValue{},
+		Headers:     headers(resp.Header, r.redact),
+		Content: Content{
+			Size:     len(data),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  comment,
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    size,
+	}
+	if resp.Proto != "" {
+		entry.Response.HTTPVersion = resp.Proto
+	}
+	entry.Time = milliseconds(now.Sub(p.started))
+	entry.Timings = Timings{Send: 0, Wait: entry.Time, Receive: 0}
+	return r.write(entry)
+}
+
+func (r *Recorder) write(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.rotate(entry.StartedDateTime); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(-int64(len(footer)), io.SeekEnd); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if !r.empty {
+		buf.WriteString(",")
+	}
+	buf.WriteString("\n")
+	buf.Write(data)
+	buf.WriteString(footer)
+	if _, err := r.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	r.empty = false
+	return nil
+}
+
+// 每天使用一个文件，已存在的文件继续追加，文件不完整时使用新的文件
+func (r *Recorder) rotate(t time.Time) error {
+	day := t.Format("2006-01-02")
+	if r.file != nil && r.day == day {
+		return nil
+	}
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	path := filepath.Join(r.opts.Dir, "wx_channels_"+day+".har")
+	file, empty, err := r.openAppend(path)
+	if err != nil {
+		path = naming.Unique(path)
+		file, empty, err = r.openAppend(path)
+	}
+	if err != nil {
+		return fmt.Errorf("打开 HAR 文件 %s 失败，%v", path, err)
+	}
+	r.file, r.empty, r.day, r.path = file, empty, day, path
+	return nil
+}
+
+// 返回的 bool 表示文件中还没有记录
+func (r *Recorder) openAppend(path string) (*os.File, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	if info.Size() == 0 {
+		creator, _ := json.Marshal(Creator{Name: "wx_channels_download", Version: r.opts.Version})
+		header := `{"log":{"version":"1.2","creator":` + string(creator) + `,"pages":[],"entries":[` + footer
+		if _, err := file.WriteString(header); err != nil {
+			file.Close()
+			return nil, false, err
+		}
+		return file, true, nil
+	}
+	tail := make([]byte, len(footer)+1)
+	if info.Size() < int64(len(tail)) {
+		file.Close()
+		return nil, false, fmt.Errorf("文件不完整")
+	}
+	if _, err := file.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	if string(tail[1:]) != footer {
+		file.Close()
+		return nil, false, fmt.Errorf("文件不完整")
+	}
+	return file, tail[0] == '[', nil
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
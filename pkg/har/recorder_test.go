@@ -0,0 +1,205 @@
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func readHAR(t *testing.T, path string) *HAR {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file HAR
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("HAR 文件格式错误，%v", err)
+	}
+	return &file
+}
+
+func testResponse(content_type string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Proto: "HTTP/1.1", Header: http.Header{"Content-Type": {content_type}}}
+}
+
+func TestRecorderRedact(t *testing.T) {
+	r, err := NewRecorder(Options{Dir: t.TempDir(), Redact: []string{" X-Custom "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "https://channels.weixin.qq.com/__wx_channels_api/profile", nil)
+	req.Header.Set("Cookie", "a=1")
+	req.Header.Set("X-Wx-Channels-Token", "secret")
+	req.Header.Set("X-Custom", "value")
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range r.newRequest(req, nil).Headers {
+		redacted := h.Name != "Content-Type"
+		if (h.Value == Redacted) != redacted {
+			t.Errorf("%s: %s", h.Name, h.Value)
+		}
+	}
+}
+
+func TestRecorderMatch(t *testing.T) {
+	r, err := NewRecorder(Options{Dir: t.TempDir(), Hosts: []string{"channels.weixin.qq.com", " .Wx.QQ.com "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"channels.weixin.qq.com", true},
+		{"CHANNELS.weixin.qq.com", true},
+		{"weixin.qq.com", false},
+		{"wx.qq.com", true},
+		{"res.wx.qq.com", true},
+		{"xwx.qq.com", false},
+		{"example.com", false},
+	} {
+		if got := r.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%s) = %v，应为 %v", tt.host, got, tt.want)
+		}
+	}
+	all, err := NewRecorder(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all.Match("example.com") {
+		t.Error("没有指定域名时应记录所有域名")
+	}
+	var none *Recorder
+	if none.Match("channels.weixin.qq.com") || none.Path() != "" || none.Close() != nil {
+		t.Error("nil 的 Recorder 不记录")
+	}
+
+	// 不符合的域名不写入文件
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.Request(1, req, nil)
+	if err := r.Response(1, req, nil, testResponse("text/html"), 2, []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if r.Path() != "" {
+		t.Fatalf("写入了 %s", r.Path())
+	}
+}
+
+// 二进制内容使用 base64，超过上限时只记录大小
+func TestRecorderBody(t *testing.T) {
+	r, err := NewRecorder(Options{Dir: t.TempDir(), MaxBody: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	binary := []byte{0x00, 0xff, 0xfe, 0x80}
+	for i, data := range [][]byte{[]byte("文本"), binary, []byte(strings.Repeat("a", 17))} {
+		req := httptest.NewRequest("POST", fmt.Sprintf("https://channels.weixin.qq.com/%d", i), nil)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		id := uint64(i + 1)
+		r.Request(id, req, data)
+		if err := r.Response(id, req, data, testResponse("application/octet-stream"), 100, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := readHAR(t, r.Path()).Log.Entries
+	if len(entries) != 3 {
+		t.Fatalf("记录了 %d 条", len(entries))
+	}
+	if c := entries[0].Response.Content; c.Text != "文本" || c.Encoding != "" || c.Size != 6 || entries[0].Response.BodySize != 100 {
+		t.Errorf("文本内容 %+v", c)
+	}
+	if c := entries[1].Response.Content; c.Encoding != "base64" || c.Text != base64.StdEncoding.EncodeToString(binary) || c.Size != 4 {
+		t.Errorf("二进制内容 %+v", c)
+	}
+	// 请求体中的二进制内容不保存
+	if p := entries[1].Request.PostData; p == nil || p.Text != "" || p.Comment == "" || entries[1].Request.BodySize != 4 {
+		t.Errorf("二进制请求体 %+v", p)
+	}
+	if c := entries[2].Response.Content; c.Text != "" || c.Comment == "" || c.Size != 17 {
+		t.Errorf("超过上限的内容 %+v", c)
+	}
+}
+
+// 多个连接同时请求时，按请求 ID 合并请求和响应
+func TestRecorderPending(t *testing.T) {
+	r, err := NewRecorder(Options{Dir: t.TempDir(), Version: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	const n = 50
+	requests := make([]*http.Request, n)
+	var wg sync.WaitGroup
+	for i := range requests {
+		requests[i] = httptest.NewRequest("POST", fmt.Sprintf("https://channels.weixin.qq.com/api?i=%d", i), nil)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.Request(uint64(i+1), requests[i], []byte(fmt.Sprintf("request %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	// 响应的顺序和请求不同，响应阶段的请求已经被修改
+	for i := n - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			modified := httptest.NewRequest("POST", "https://channels.weixin.qq.com/modified", nil)
+			if err := r.Response(uint64(i+1), modified, []byte("modified"), testResponse("text/plain"), 0, []byte(fmt.Sprintf("response %d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 请求阶段没有记录的使用响应阶段的请求
+	direct := httptest.NewRequest("GET", "https://channels.weixin.qq.com/direct", nil)
+	if err := r.Response(1000, direct, nil, testResponse("text/plain"), 0, []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+
+	file := readHAR(t, r.Path())
+	if file.Log.Version != "1.2" || file.Log.Creator.Version != "test" || len(file.Log.Entries) != n+1 {
+		t.Fatalf("log = %+v，%d 条", file.Log.Creator, len(file.Log.Entries))
+	}
+	seen := make(map[string]bool)
+	for _, entry := range file.Log.Entries {
+		if entry.Request.URL == direct.URL.String() {
+			if entry.Response.Content.Text != "direct" {
+				t.Errorf("direct 的响应 %q", entry.Response.Content.Text)
+			}
+			continue
+		}
+		var i int
+		if _, err := fmt.Sscanf(entry.Response.Content.Text, "response %d", &i); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Request.URL != requests[i].URL.String() || entry.Request.PostData.Text != fmt.Sprintf("request %d", i) {
+			t.Errorf("响应 %d 对应的请求是 %s %q", i, entry.Request.URL, entry.Request.PostData.Text)
+		}
+		seen[entry.Request.URL] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("只记录了 %d 个请求", len(seen))
+	}
+
+	// 重新打开时在原来的文件后面追加
+	r.Close()
+	r, err = NewRecorder(Options{Dir: r.opts.Dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Response(1, direct, nil, testResponse("text/plain"), 0, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readHAR(t, r.Path()).Log.Entries; len(entries) != n+2 {
+		t.Fatalf("追加之后有 %d 条", len(entries))
+	}
+}
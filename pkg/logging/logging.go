@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 日志中隐藏值的请求头和字段
+var sensitive = map[string]bool{
+	"cookie":              true,
+	"set-cookie":          true,
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+const Redacted = "[REDACTED]"
+
+type Options struct {
+	// debug info warn error
+	Level string
+	// text 或 json
+	Format string
+	// 同时写入的日志文件，为空时只输出到终端
+	File string
+	// 日志文件超过该字节数后轮转
+	MaxSize int64
+}
+
+// 创建 logger，返回的 io.Closer 用于关闭日志文件
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.Writer = os.Stdout
+	var closer io.Closer = nopCloser{}
+	if opts.File != "" {
+		file, err := OpenRotating(opts.File, opts.MaxSize, defaultBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("打开日志文件失败，%v", err)
+		}
+		w = io.MultiWriter(os.Stdout, file)
+		closer = file
+	}
+	handler_opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, handler_opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handler_opts)
+	default:
+		return nil, nil, fmt.Errorf("不支持的日志格式 %s，可用的格式有 text json", opts.Format)
+	}
+	return slog.New(handler), closer, nil
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("不支持的日志级别 %s，可用的级别有 debug info warn error", s)
+}
+
+// 名称为 Cookie Authorization 等的字段只输出 [REDACTED]
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitive[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// 复制一份请求头或响应头，隐藏 Cookie 和 Authorization 等的值
+func RedactHeaders(h http.Header) http.Header {
+	copied := make(http.Header, len(h))
+	for name, values := range h {
+		if sensitive[strings.ToLower(name)] {
+			copied[name] = []string{Redacted}
+			continue
+		}
+		copied[name] = values
+	}
+	return copied
+}
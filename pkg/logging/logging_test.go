@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "wx_channels.log")
+	r, err := OpenRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// 每行 6 个字节，写入第二行时超过 10 个字节，轮转之后写入新文件
+	for i := 1; i <= 5; i++ {
+		if _, err := fmt.Fprintf(r, "line%d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{path, "line5\n"},
+		{path + ".1", "line4\n"},
+		{path + ".2", "line3\n"},
+	} {
+		if got := readLog(t, tt.path); got != tt.want {
+			t.Errorf("%s = %q，应为 %q", filepath.Base(tt.path), got, tt.want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("超出数量的日志文件没有删除")
+	}
+	// 单次写入超过上限时不轮转空文件
+	r.Close()
+	os.Remove(path)
+	r, err = OpenRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte(strings.Repeat("x", 20))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, path+".1"); got != "line4\n" {
+		t.Fatalf("写入空文件时轮转了，.1 = %q", got)
+	}
+	r.Close()
+	if _, err := r.Write([]byte("closed")); err != os.ErrClosed {
+		t.Fatalf("关闭之后 err = %v", err)
+	}
+}
+
+// 重命名失败时继续写入原来的文件
+func TestRotatingFileRenameFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wx_channels.log")
+	// 不为空的目录不能被删除，也不能被文件覆盖
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenRotating(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	for i := 1; i <= 3; i++ {
+		if _, err := fmt.Fprintf(r, "line%d\n", i); err != nil {
+			t.Fatalf("第 %d 行写入失败，%v", i, err)
+		}
+	}
+	if got := readLog(t, path); got != "line1\nline2\nline3\n" {
+		t.Fatalf("log = %q", got)
+	}
+	// 可以重命名之后恢复轮转
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(r, "line4\n")
+	if got := readLog(t, path); got != "line4\n" {
+		t.Fatalf("log = %q", got)
+	}
+	if got := readLog(t, path+".1"); got != "line1\nline2\nline3\n" {
+		t.Fatalf(".1 = %q", got)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+	header := http.Header{}
+	header.Set("Cookie", "session=1")
+	header.Set("Set-Cookie", "session=2")
+	header.Set("Authorization", "Bearer token")
+	header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	header.Set("Content-Type", "text/html")
+	logger.Info("请求", "headers", RedactHeaders(header), "cookie", "session=3", slog.Group("req", "Authorization", "Bearer token2"), "url", "https://channels.weixin.qq.com")
+	if strings.Contains(buf.String(), "session=") || strings.Contains(buf.String(), "token") || strings.Contains(buf.String(), "dXNlcjpwYXNz") {
+		t.Fatalf("日志中有敏感信息，%s", buf.String())
+	}
+	var record struct {
+		Headers map[string][]string `json:"headers"`
+		Cookie  string              `json:"cookie"`
+		Req     map[string]string   `json:"req"`
+		URL     string              `json:"url"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Headers["Cookie"][0] != Redacted || record.Headers["Content-Type"][0] != "text/html" || record.Cookie != Redacted || record.Req["Authorization"] != Redacted || record.URL != "https://channels.weixin.qq.com" {
+		t.Fatalf("record = %+v", record)
+	}
+	// 不修改原来的请求头
+	if header.Get("Cookie") != "session=1" {
+		t.Fatal("RedactHeaders 修改了原来的请求头")
+	}
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 默认日志文件大小上限
+const DefaultMaxSize = 10 << 20
+
+// 保留的旧日志文件数量，wx_channels.log.1 为最近的一个
+const defaultBackups = 5
+
+// 按大小轮转的日志文件
+type RotatingFile struct {
+	path     string
+	max_size int64
+	backups  int
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func OpenRotating(path string, max_size int64, backups int) (*RotatingFile, error) {
+	if max_size <= 0 {
+		max_size = DefaultMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{path: path, max_size: max_size, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.max_size {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// wx_channels.log.4 -> .5 ... wx_channels.log -> .1，超出数量的删除
+// 重命名失败时继续写入原来的文件，再写入 max_size 之后重试
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	rename_err := os.Rename(r.path, r.path+".1")
+	if err := r.open(); err != nil {
+		return err
+	}
+	if rename_err != nil {
+		// 不能使用 slog，日志正在写入这个文件
+		fmt.Fprintf(os.Stderr, "日志文件轮转失败，%v\n", rename_err)
+		r.size = 0
+	}
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
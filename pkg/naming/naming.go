@@ -0,0 +1,263 @@
+package naming
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 单个文件名最多占用的字节数，文件系统一般限制为 255
+// 预留出 .part.json.tmp 和重名时 " (99)" 的长度
+const MaxNameBytes = 200
+
+// 模板中可以使用的字段
+// 值为 time.Time 或 int64（秒级时间戳）时可以指定时间格式，如 {createtime:2006-01-02}
+// 值为字符串时可以指定最大字符数，如 {title:60}
+type Fields map[string]interface{}
+
+type placeholder struct {
+	names []string
+	arg   string
+}
+
+type part struct {
+	text string
+	ph   *placeholder
+}
+
+// 文件路径模板，如 {nickname}/{createtime:2006-01-02}_{title:60}_{spec}.mp4
+// {title|id} 表示 title 为空时使用 id
+// 字段的值为空时，会去掉紧挨在前面的一个 _ - 或空格，在开头时去掉后面的
+type Template struct {
+	raw   string
+	parts []part
+}
+
+func Parse(s string) (*Template, error) {
+	t := &Template{raw: s}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '{')
+		if i == -1 {
+			t.parts = append(t.parts, part{text: s})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, part{text: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j == -1 {
+			return nil, fmt.Errorf("模板 %s 缺少 }", t.raw)
+		}
+		body := s[i+1 : i+j]
+		ph := &placeholder{}
+		if k := strings.IndexByte(body, ':'); k != -1 {
+			ph.arg = body[k+1:]
+			body = body[:k]
+		}
+		for _, name := range strings.Split(body, "|") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("模板 %s 中有空的字段名", t.raw)
+			}
+			ph.names = append(ph.names, name)
+		}
+		t.parts = append(t.parts, part{ph: ph})
+		s = s[i+j+1:]
+	}
+	return t, nil
+}
+
+func MustParse(s string) *Template {
+	t, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+// 生成相对路径，模板中的 / 表示目录，字段值中的 / 会被替换
+func (t *Template) Render(fields Fields) string {
+	var b strings.Builder
+	// 目录开头的字段为空时，去掉后面紧挨着的分隔符
+	skip_sep := false
+	for _, p := range t.parts {
+		if p.ph == nil {
+			text := p.text
+			if skip_sep && text != "" && strings.ContainsRune("_- ", rune(text[0])) {
+				text = text[1:]
+			}
+			skip_sep = false
+			b.WriteString(text)
+			continue
+		}
+		value := p.ph.render(fields)
+		if value == "" {
+			cur := b.String()
+			if n := len(cur); n > 0 && strings.ContainsRune("_- ", rune(cur[n-1])) {
+				b.Reset()
+				b.WriteString(cur[:n-1])
+			} else if n == 0 || cur[n-1] == '/' {
+				skip_sep = true
+			}
+			continue
+		}
+		skip_sep = false
+		// 字段值中的路径分隔符不能生成目录
+		b.WriteString(strings.NewReplacer("/", "_", "\\", "_").Replace(value))
+	}
+	segments := strings.Split(b.String(), "/")
+	for i, seg := range segments {
+		segments[i] = Sanitize(seg)
+	}
+	return filepath.Join(segments...)
+}
+
+func (ph *placeholder) render(fields Fields) string {
+	for _, name := range ph.names {
+		v, ok := fields[name]
+		if !ok || v == nil {
+			continue
+		}
+		if s := format(v, ph.arg); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func format(v interface{}, arg string) string {
+	switch val := v.(type) {
+	case time.Time:
+		if val.IsZero() {
+			return ""
+		}
+		if arg == "" {
+			arg = "20060102_150405"
+		}
+		return val.Format(arg)
+	case int64:
+		if arg != "" && !isNumber(arg) {
+			if val == 0 {
+				return ""
+			}
+			return time.Unix(val, 0).Format(arg)
+		}
+		if val == 0 {
+			return ""
+		}
+		return strconv.FormatInt(val, 10)
+	case int:
+		return format(int64(val), arg)
+	case string:
+		val = StripEmoji(strings.TrimSpace(val))
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			val = truncateRunes(val, n)
+		}
+		return val
+	}
+	return fmt.Sprint(v)
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func truncateRunes(s string, n int) string {
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// 按字节截断，不会截断到一个字符的中间
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// 去掉 emoji 以及组合 emoji 用到的连接符和变体选择符
+func StripEmoji(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == 0x200d, r >= 0xfe00 && r <= 0xfe0f, r == 0x20e3:
+			return -1
+		case r >= 0x1f000 && r <= 0x1faff, r >= 0x2600 && r <= 0x27bf, r >= 0x1f1e6 && r <= 0x1f1ff:
+			return -1
+		case r >= 0xe0020 && r <= 0xe007f:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"COM¹": true, "COM²": true, "COM³": true, "LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// 处理成在 Windows、macOS 和 Linux 上都可以使用的文件名
+func Sanitize(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || unicode.IsControl(r) {
+			if r == '\n' || r == '\t' {
+				return ' '
+			}
+			return -1
+		}
+		if strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows 不允许以点或空格结尾，截断之后需要再处理一次
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	ext := filepath.Ext(name)
+	if ext == "." || len(ext) > 16 || strings.ContainsRune(ext, ' ') {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	base = strings.TrimRight(truncateBytes(base, MaxNameBytes-len(ext)), ". ")
+	if base == "" {
+		base = "_"
+	}
+	if reservedNames[strings.ToUpper(strings.SplitN(base, ".", 2)[0])] {
+		base = "_" + base
+	}
+	return base + ext
+}
+
+// 文件已经存在时在扩展名前加上 (1) (2) 等序号
+func Unique(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
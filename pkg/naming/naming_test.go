@@ -0,0 +1,100 @@
+package naming
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		// 保留的设备名
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"nul.tar.gz", "_nul.tar.gz"},
+		{"COM0", "_COM0"},
+		{"LPT9.mp4", "_LPT9.mp4"},
+		{"com¹", "_com¹"},
+		{"LPT³.mp4", "_LPT³.mp4"},
+		{"COM10", "COM10"},
+		{"CONSOLE", "CONSOLE"},
+		// 结尾的点和空格
+		{"abc.", "abc"},
+		{"abc .", "abc"},
+		{"abc. . ", "abc"},
+		{"a. .mp4", "a.mp4"},
+		{".", "_"},
+		{"..", "_"},
+		{" .hidden", "_.hidden"},
+		// 空的和全部是非法字符
+		{"", "_"},
+		{"   ", "_"},
+		{"\x00\x01\x7f", "_"},
+		{`a<b>c:d"e/f\g|h?i*`, "a_b_c_d_e_f_g_h_i_"},
+		{"a\nb\tc", "a b c"},
+	} {
+		if got := Sanitize(tt.name); got != tt.want {
+			t.Errorf("Sanitize(%q) = %q，应为 %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 超过长度时按字节截断，不能截断到字符中间，截断之后也不能以点结尾
+func TestSanitizeTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{strings.Repeat("中", 100), strings.Repeat("中", 66)},
+		{strings.Repeat("中", 100) + ".mp4", strings.Repeat("中", 65) + ".mp4"},
+		{strings.Repeat("😀", 60), strings.Repeat("😀", 50)},
+		{"a" + strings.Repeat("😀", 60) + ".mp4", "a" + strings.Repeat("😀", 48) + ".mp4"},
+		{strings.Repeat("a", 199) + "." + strings.Repeat("b", 20), strings.Repeat("a", 199)},
+	} {
+		got := Sanitize(tt.name)
+		if got != tt.want {
+			t.Errorf("Sanitize(%.20q...) = %.20q... (%d 字节)，应为 %d 字节", tt.name, got, len(got), len(tt.want))
+		}
+		if len(got) > MaxNameBytes || !utf8.ValidString(got) {
+			t.Errorf("%.20q... 截断之后 %d 字节", got, len(got))
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local)
+	for _, tt := range []struct {
+		template string
+		fields   Fields
+		want     string
+	}{
+		{"{title|id}_{spec}.mp4", Fields{"title": "标题", "id": "1", "spec": "xWT111"}, "标题_xWT111.mp4"},
+		{"{title|id}_{spec}.mp4", Fields{"title": "  ", "id": "1", "spec": "xWT111"}, "1_xWT111.mp4"},
+		{"{title}_{spec}.mp4", Fields{"spec": "xWT111"}, "xWT111.mp4"},
+		{"{title}_{spec}.mp4", Fields{"title": "标题"}, "标题.mp4"},
+		{"{title:2}-{createtime:2006-01-02}.mp4", Fields{"title": "一二三", "createtime": created}, "一二-2024-05-06.mp4"},
+		{"{title}-{createtime:2006-01-02}.mp4", Fields{"title": "标题", "createtime": time.Time{}}, "标题.mp4"},
+		{"{title}_{createtime}.mp4", Fields{"title": "标题", "createtime": int64(0)}, "标题.mp4"},
+		{"{title}.mp4", Fields{"title": "a/b😀"}, "a_b.mp4"},
+		{"{nickname}/{title}.mp4", Fields{"nickname": "a.", "title": "标题"}, "a/标题.mp4"},
+		{"{nickname}/{title}.mp4", Fields{"nickname": "..", "title": "标题"}, "_/标题.mp4"},
+		{"{nickname}/{title}.mp4", Fields{"title": "标题"}, "_/标题.mp4"},
+		{"{nickname}/{title}_{id}.mp4", Fields{"nickname": "CON", "id": "1"}, "_CON/1.mp4"},
+	} {
+		got := MustParse(tt.template).Render(tt.fields)
+		if got != strings.ReplaceAll(tt.want, "/", string(filepath.Separator)) {
+			t.Errorf("%s %v 生成 %q，应为 %q", tt.template, tt.fields, got, tt.want)
+		}
+	}
+	if _, err := Parse("{title"); err == nil {
+		t.Error("缺少 } 时应返回错误")
+	}
+	if _, err := Parse("{title|}"); err == nil {
+		t.Error("空的字段名应返回错误")
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 建立到 addr 的 TCP 连接，设置了上游代理时通过 CONNECT 或 SOCKS5 建立隧道
+func (u *Upstream) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	if u == nil || u.Bypassed(addr) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("连接上游代理失败，%v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if u.URL.Scheme == "https" {
+		tls_conn := tls.Client(conn, &tls.Config{ServerName: u.URL.Hostname()})
+		if err := tls_conn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("连接上游代理失败，%v", err)
+		}
+		conn = tls_conn
+	}
+	switch u.URL.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, u.URL.User, addr)
+	default:
+		conn, err = httpConnect(conn, u.URL.User, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, fmt.Errorf("上游代理 CONNECT 失败，%v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, fmt.Errorf("上游代理 CONNECT 失败，%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("上游代理 CONNECT %s 失败，%s", addr, resp.Status)
+	}
+	// 服务器可能已经发送了数据
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// RFC 1928 和 RFC 1929 用户名密码认证
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, port_str, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil {
+		return fmt.Errorf("端口格式错误，%v", err)
+	}
+	methods := []byte{0x00}
+	if user != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("SOCKS5 握手失败，%v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("SOCKS5 握手失败，%v", err)
+	}
+	if reply[0] != 0x05 {
+		return errors.New("SOCKS5 握手失败，上游代理不是 SOCKS5 代理")
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return errors.New("SOCKS5 上游代理需要用户名和密码")
+		}
+		password, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 用户名或密码太长")
+		}
+		auth := []byte{0x01, byte(len(name))}
+		auth = append(auth, name...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("SOCKS5 认证失败，%v", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("SOCKS5 认证失败，%v", err)
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 认证失败，用户名或密码错误")
+		}
+	default:
+		return errors.New("SOCKS5 握手失败，没有可用的认证方式")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 域名太长")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("SOCKS5 连接 %s 失败，%v", addr, err)
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return fmt.Errorf("SOCKS5 连接 %s 失败，%v", addr, err)
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 连接 %s 失败，错误码 %d", addr, head[1])
+	}
+	// 跳过 BND.ADDR 和 BND.PORT
+	var size int
+	switch head[3] {
+	case 0x01:
+		size = 4
+	case 0x04:
+		size = 16
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return fmt.Errorf("SOCKS5 连接 %s 失败，%v", addr, err)
+		}
+		size = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 连接 %s 失败，未知的地址类型 %d", addr, head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, size+2)); err != nil {
+		return fmt.Errorf("SOCKS5 连接 %s 失败，%v", addr, err)
+	}
+	return nil
+}
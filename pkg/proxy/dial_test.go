@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在本地监听，每个连接调用一次 serve
+func listenTest(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// 通过上游代理连接 addr，读取隧道中服务器发送的一行
+func dialTest(t *testing.T, upstream string, addr string) (string, error) {
+	t.Helper()
+	u, err := ParseUpstream(upstream, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := u.DialContext(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// 模拟 HTTP 代理，status 不为 200 时拒绝 CONNECT，auth 不为空时检查 Proxy-Authorization
+func fakeConnectProxy(t *testing.T, status int, auth string) string {
+	return listenTest(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+			return
+		}
+		// 响应之后紧接着发送隧道中的数据，检查 bufferedConn 没有丢掉
+		fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\nconnected %s\n", req.Host)
+	})
+}
+
+func TestHTTPConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   int
+		auth     string
+		userinfo string
+		want     string
+		err      string
+	}{
+		{"no auth", http.StatusOK, "", "", "connected example.com:443", ""},
+		// user:pass 的 Base64
+		{"auth", http.StatusOK, "Basic dXNlcjpwYXNz", "user:pass@", "connected example.com:443", ""},
+		{"wrong password", http.StatusOK, "Basic dXNlcjpwYXNz", "user:wrong@", "", "407"},
+		{"forbidden", http.StatusForbidden, "", "", "", "403"},
+	} {
+		addr := fakeConnectProxy(t, tt.status, tt.auth)
+		got, err := dialTest(t, "http://"+tt.userinfo+addr, "example.com:443")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v，应包含 %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %q %v，应为 %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+type fakeSocks struct {
+	user, password string
+	// 连接请求的响应码
+	code byte
+	// 响应中 BND.ADDR 的类型
+	bind_type byte
+	// 没有可用的认证方式时返回 0xff
+	no_method bool
+}
+
+// 模拟 SOCKS5 代理，连接成功之后发送客户端请求的地址
+func (s fakeSocks) listen(t *testing.T) string {
+	return listenTest(t, func(conn net.Conn) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		switch {
+		case s.no_method:
+			conn.Write([]byte{0x05, 0xff})
+			return
+		case s.user == "":
+			conn.Write([]byte{0x05, 0x00})
+		default:
+			if !strings.ContainsRune(string(methods), 0x02) {
+				conn.Write([]byte{0x05, 0xff})
+				return
+			}
+			conn.Write([]byte{0x05, 0x02})
+			reader := bufio.NewReader(conn)
+			version, _ := reader.ReadByte()
+			n, _ := reader.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(reader, name)
+			n, _ = reader.ReadByte()
+			password := make([]byte, n)
+			io.ReadFull(reader, password)
+			if version != 0x01 || string(name) != s.user || string(password) != s.password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil || req[1] != 0x01 {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 0x01, 0x04:
+			ip := make(net.IP, 4)
+			if req[3] == 0x04 {
+				ip = make(net.IP, 16)
+			}
+			io.ReadFull(conn, ip)
+			host = fmt.Sprintf("%d %s", req[3], ip)
+		case 0x03:
+			n := make([]byte, 1)
+			io.ReadFull(conn, n)
+			name := make([]byte, n[0])
+			io.ReadFull(conn, name)
+			host = fmt.Sprintf("%d %s", req[3], name)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+
+		reply := []byte{0x05, s.code, 0x00, s.bind_type}
+		switch s.bind_type {
+		case 0x01:
+			reply = append(reply, 127, 0, 0, 1)
+		case 0x04:
+			reply = append(reply, net.IPv6loopback...)
+		case 0x03:
+			reply = append(reply, 9)
+			reply = append(reply, "localhost"...)
+		}
+		reply = binary.BigEndian.AppendUint16(reply, 1080)
+		conn.Write(reply)
+		if s.code == 0x00 {
+			fmt.Fprintf(conn, "%s %d\n", host, binary.BigEndian.Uint16(port))
+		}
+	})
+}
+
+func TestSocks5Connect(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		server   fakeSocks
+		userinfo string
+		addr     string
+		want     string
+		err      string
+	}{
+		{"domain", fakeSocks{bind_type: 0x01}, "", "example.com:443", "3 example.com 443", ""},
+		{"ipv4", fakeSocks{bind_type: 0x01}, "", "1.2.3.4:80", "1 1.2.3.4 80", ""},
+		{"ipv6", fakeSocks{bind_type: 0x01}, "", "[2001:db8::1]:8080", "4 2001:db8::1 8080", ""},
+		{"bind ipv6", fakeSocks{bind_type: 0x04}, "", "example.com:443", "3 example.com 443", ""},
+		{"bind domain", fakeSocks{bind_type: 0x03}, "", "example.com:443", "3 example.com 443", ""},
+		{"auth", fakeSocks{user: "user", password: "pass", bind_type: 0x01}, "user:pass@", "example.com:443", "3 example.com 443", ""},
+		{"wrong password", fakeSocks{user: "user", password: "pass"}, "user:wrong@", "example.com:443", "", "用户名或密码错误"},
+		{"need auth", fakeSocks{user: "user", password: "pass"}, "", "example.com:443", "", "没有可用的认证方式"},
+		{"no method", fakeSocks{no_method: true}, "", "example.com:443", "", "没有可用的认证方式"},
+		{"not allowed", fakeSocks{code: 0x02, bind_type: 0x01}, "", "example.com:443", "", "错误码 2"},
+		{"refused", fakeSocks{code: 0x05, bind_type: 0x01}, "", "example.com:443", "", "错误码 5"},
+		{"bad bind type", fakeSocks{bind_type: 0x09}, "", "example.com:443", "", "未知的地址类型 9"},
+	} {
+		got, err := dialTest(t, "socks5://"+tt.userinfo+tt.server.listen(t), tt.addr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v，应包含 %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %q %v，应为 %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// 不使用上游代理的地址直接连接
+func TestDialBypass(t *testing.T) {
+	addr := listenTest(t, func(conn net.Conn) {
+		io.WriteString(conn, "direct\n")
+	})
+	// 上游代理的端口没有监听，使用了上游代理时会失败
+	got, err := dialTest(t, "http://127.0.0.2:1", addr)
+	if err != nil || got != "direct" {
+		t.Fatalf("%q %v", got, err)
+	}
+}
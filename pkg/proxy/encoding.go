@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 可以解码的 Content-Encoding
+var supportedEncodings = map[string]bool{
+	"gzip":     true,
+	"x-gzip":   true,
+	"deflate":  true,
+	"br":       true,
+	"zstd":     true,
+	"identity": true,
+}
+
+// 去掉 Accept-Encoding 中无法解码的压缩方式，如 dcb dcz，以及 q=0 的压缩方式，其余的原样保留
+// *;q=0 表示不接受没有列出的压缩方式，需要保留
+func AcceptEncoding(header string) string {
+	var list []string
+	for _, item := range strings.Split(header, ",") {
+		item = strings.TrimSpace(item)
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !supportedEncodings[name] && name != "*" {
+			continue
+		}
+		if name != "*" && zeroQuality(params) {
+			continue
+		}
+		list = append(list, item)
+	}
+	return strings.Join(list, ", ")
+}
+
+func zeroQuality(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(strings.TrimSpace(key), "q") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q == 0
+		}
+	}
+	return false
+}
+
+// 按 Content-Encoding 解码响应体，多次编码时按相反的顺序解码，如 gzip, br
+func DecodeBody(encoding string, body []byte) ([]byte, error) {
+	names := strings.Split(encoding, ",")
+	for i := len(names) - 1; i >= 0; i-- {
+		name := strings.ToLower(strings.TrimSpace(names[i]))
+		decoded, err := decode(name, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s 解码失败，%v", name, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+func decode(name string, body []byte) ([]byte, error) {
+	switch name {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "deflate":
+		// 标准是 zlib 格式，部分服务器直接发送 deflate 数据
+		if r, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		return io.ReadAll(r)
+	case "br":
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	case "zstd":
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(body, nil)
+	}
+	return nil, fmt.Errorf("不支持的压缩方式")
+}
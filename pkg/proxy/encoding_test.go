@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 使用 name 压缩 data
+func encode(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch name {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("未知的压缩方式 %s", name)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(strings.Repeat("<script>window.__wx_channels_store__</script>\n", 100))
+	for _, tt := range []struct {
+		encoding string
+		// 按顺序压缩
+		steps []string
+	}{
+		{"", nil},
+		{"identity", nil},
+		{"gzip", []string{"gzip"}},
+		{"X-Gzip", []string{"gzip"}},
+		{"deflate", []string{"deflate"}},
+		// 部分服务器发送的 deflate 没有 zlib 头
+		{"deflate", []string{"raw-deflate"}},
+		{"br", []string{"br"}},
+		{"zstd", []string{"zstd"}},
+		// 先 gzip 再 br，解码时先 br 再 gzip
+		{"gzip, br", []string{"gzip", "br"}},
+		{"br,zstd", []string{"br", "zstd"}},
+		{"gzip, identity", []string{"gzip"}},
+	} {
+		body := plain
+		for _, step := range tt.steps {
+			body = encode(t, step, body)
+		}
+		got, err := DecodeBody(tt.encoding, body)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%q %v 解码失败，%v", tt.encoding, tt.steps, err)
+		}
+	}
+	// 顺序错误时解码失败
+	if _, err := DecodeBody("br, gzip", encode(t, "br", encode(t, "gzip", plain))); err == nil {
+		t.Error("顺序错误时应返回错误")
+	}
+	for _, encoding := range []string{"gzip", "zstd", "dcb"} {
+		if _, err := DecodeBody(encoding, plain); err == nil || !strings.Contains(err.Error(), encoding) {
+			t.Errorf("%s 解码未压缩的内容时 err = %v", encoding, err)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip, deflate, br, zstd", "gzip, deflate, br, zstd"},
+		{"gzip, deflate, br, zstd, dcb, dcz", "gzip, deflate, br, zstd"},
+		{"dcb, dcz", ""},
+		{"gzip;q=1.0, br;q=0.8, compress;q=0.5", "gzip;q=1.0, br;q=0.8"},
+		{"gzip;q=0, br", "br"},
+		{"br; q=0.000, gzip", "gzip"},
+		{"GZIP;Q=0.0, Br;q=0.1", "Br;q=0.1"},
+		{"identity;q=0, gzip", "gzip"},
+		{"gzip, *;q=0", "gzip, *;q=0"},
+		{"*", "*"},
+		{"gzip;q=abc", "gzip;q=abc"},
+	} {
+		if got := AcceptEncoding(tt.header); got != tt.want {
+			t.Errorf("AcceptEncoding(%q) = %q，应为 %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// 拦截到的一次 HTTP 请求，请求阶段 Response 为 nil
+type Conn interface {
+	// 同一次请求在请求阶段和响应阶段相同
+	ID() uint64
+	// 完整的请求地址在 Request().URL 中，请求体使用 RequestBody 获取，超过 32MB 时直接转发给服务器，RequestBody 为 nil
+	Request() *http.Request
+	RequestBody() []byte
+	SetRequestBody(body []byte)
+	Response() *http.Response
+	ResponseBody() []byte
+	SetResponseBody(body []byte)
+	// 不再请求服务器，直接返回指定的响应
+	StopRequest(status int, body []byte, header http.Header)
+}
+
+type Handler func(conn Conn)
+
+// 中间人代理，负责解密 HTTPS 并在请求和响应时调用 Handler
+type Engine interface {
+	Start() error
+	Stop() error
+	OnRequest(h Handler)
+	OnResponse(h Handler)
+	// 在 Start 之前调用，nil 表示直接连接
+	SetUpstream(u *Upstream) error
+	// 在 Start 之前调用，nil 表示解密所有 HTTPS 连接
+	SetInterceptPolicy(p *InterceptPolicy) error
+}
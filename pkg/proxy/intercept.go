@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// 默认只解密视频号页面、脚本和视频 CDN 的流量
+var DefaultInterceptHosts = []string{
+	"channels.weixin.qq.com",
+	"res.wx.qq.com",
+	"finder.video.qq.com",
+	"findermp.video.qq.com",
+}
+
+// 启动时访问该地址检查证书是否已安装，需要始终解密
+const probeHost = "sunny.io"
+
+// 需要解密的 HTTPS 域名，其余的 CONNECT 连接直接转发，不解密也不调用 Handler
+type InterceptPolicy struct {
+	// 规则见 matchHost，* 表示解密所有域名
+	Hosts []string
+}
+
+// hosts 使用逗号或分号分隔，为空时使用默认的域名
+func ParseInterceptPolicy(hosts string) *InterceptPolicy {
+	list := splitRules(hosts)
+	if len(list) == 0 {
+		list = append([]string{}, DefaultInterceptHosts...)
+	}
+	return &InterceptPolicy{Hosts: list}
+}
+
+// 为 nil 时解密所有域名
+func (p *InterceptPolicy) Intercepted(host string) bool {
+	if p == nil {
+		return true
+	}
+	return matchHost(p.Hosts, host) || matchHost([]string{probeHost}, host)
+}
+
+func (p *InterceptPolicy) All() bool {
+	return p == nil || matchHost(p.Hosts, "*")
+}
+
+func (p *InterceptPolicy) String() string {
+	if p.All() {
+		return "*"
+	}
+	return strings.Join(p.Hosts, ", ")
+}
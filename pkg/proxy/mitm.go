@@ -0,0 +1,569 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wx_channel/pkg/certificate"
+)
+
+// 超过这个大小或者是音视频等内容时，响应直接转发给客户端，不调用 OnResponse
+const maxBufferedBody = 32 << 20
+
+// 不调用 OnResponse，直接转发的响应类型
+var streamedContentTypes = []string{"video/", "audio/", "image/", "application/octet-stream"}
+
+// 请求和响应中只在当前连接有效的头，转发时需要删除
+// WebSocket 等协议升级的请求和 101 响应会重新加上 Connection 和 Upgrade
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 使用 net/http 和 crypto/tls 实现的代理，所有系统都可以使用
+type MITMEngine struct {
+	Addr string
+	// 请求服务器使用的 Transport
+	Transport   http.RoundTripper
+	upstream    *Upstream
+	policy      *InterceptPolicy
+	ca          *certificate.CA
+	leaf_key    *ecdsa.PrivateKey
+	certs       map[string]*tls.Certificate
+	certs_mu    sync.Mutex
+	listener    net.Listener
+	conns       map[net.Conn]struct{}
+	conns_mu    sync.Mutex
+	on_request  Handler
+	on_response Handler
+}
+
+func NewMITMEngine(addr string, ca *certificate.CA) (*MITMEngine, error) {
+	// 所有站点的证书使用同一个私钥，避免每次生成
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成证书私钥失败，%v", err)
+	}
+	return &MITMEngine{
+		Addr: addr,
+		Transport: &http.Transport{
+			DisableCompression:  true,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		ca:       ca,
+		leaf_key: key,
+		certs:    make(map[string]*tls.Certificate),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func (e *MITMEngine) OnRequest(h Handler) {
+	e.on_request = h
+}
+
+func (e *MITMEngine) OnResponse(h Handler) {
+	e.on_response = h
+}
+
+func (e *MITMEngine) SetUpstream(u *Upstream) error {
+	transport, ok := e.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("不支持设置上游代理")
+	}
+	transport.Proxy = nil
+	if u != nil {
+		transport.Proxy = u.Proxy
+	}
+	e.upstream = u
+	return nil
+}
+
+func (e *MITMEngine) SetInterceptPolicy(p *InterceptPolicy) error {
+	e.policy = p
+	return nil
+}
+
+func (e *MITMEngine) Start() error {
+	listener, err := net.Listen("tcp", e.Addr)
+	if err != nil {
+		return fmt.Errorf("启动代理失败，%v", err)
+	}
+	e.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go e.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (e *MITMEngine) Stop() error {
+	if e.listener == nil {
+		return nil
+	}
+	err := e.listener.Close()
+	e.conns_mu.Lock()
+	for conn := range e.conns {
+		conn.Close()
+	}
+	e.conns_mu.Unlock()
+	return err
+}
+
+// 实际监听的地址，Addr 的端口为 0 时可以获取随机分配的端口
+func (e *MITMEngine) ListenAddr() net.Addr {
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Addr()
+}
+
+func (e *MITMEngine) track(conn net.Conn, add bool) {
+	e.conns_mu.Lock()
+	defer e.conns_mu.Unlock()
+	if add {
+		e.conns[conn] = struct{}{}
+	} else {
+		delete(e.conns, conn)
+	}
+}
+
+func (e *MITMEngine) serve(conn net.Conn) {
+	e.track(conn, true)
+	defer e.track(conn, false)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if req.Method == http.MethodConnect {
+		e.serveConnect(conn, reader, req.Host)
+		return
+	}
+	e.serveHTTP(conn, reader, req, "http", "")
+}
+
+// HTTPS 请求，建立隧道后使用根证书签发的证书和客户端握手
+func (e *MITMEngine) serveConnect(conn net.Conn, reader *bufio.Reader, host string) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	} else {
+		host = net.JoinHostPort(host, "443")
+	}
+	if !e.policy.Intercepted(hostname) {
+		e.tunnel(conn, reader, host)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	tls_conn := tls.Server(&bufferedConn{Conn: conn, reader: reader}, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return e.certificate(name)
+		},
+	})
+	if err := tls_conn.Handshake(); err != nil {
+		return
+	}
+	tls_reader := bufio.NewReader(tls_conn)
+	req, err := http.ReadRequest(tls_reader)
+	if err != nil {
+		return
+	}
+	e.serveHTTP(tls_conn, tls_reader, req, "https", host)
+}
+
+// 不需要解密的连接，直接和服务器建立隧道
+func (e *MITMEngine) tunnel(conn net.Conn, reader *bufio.Reader, host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	server, err := e.upstream.DialContext(ctx, host)
+	cancel()
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	defer server.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(server, reader)
+		// 客户端关闭后通知服务器，服务器的数据仍然可以继续发送
+		if c, ok := server.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			server.Close()
+		}
+		close(done)
+	}()
+	io.Copy(conn, server)
+	conn.Close()
+	<-done
+}
+
+// 处理同一个连接上的所有请求
+func (e *MITMEngine) serveHTTP(conn net.Conn, reader *bufio.Reader, req *http.Request, scheme, host string) {
+	for {
+		// 代理请求的地址是完整的 URL，否则是直接访问代理
+		local := scheme == "http" && !req.URL.IsAbs()
+		if req.URL.Host == "" {
+			req.URL.Host = req.Host
+			if req.URL.Host == "" {
+				req.URL.Host = host
+			}
+			req.URL.Scheme = scheme
+		}
+		var resp *http.Response
+		if local || req.URL.Host == "" {
+			resp = e.serveLocal(req)
+		} else {
+			resp = e.roundTrip(req)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			switchProtocols(conn, reader, resp)
+			return
+		}
+		close_conn := req.Close || resp.Close
+		err := writeResponse(conn, resp)
+		resp.Body.Close()
+		if err != nil || close_conn {
+			return
+		}
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 直接访问代理地址时下载根证书，方便在浏览器中安装
+func (e *MITMEngine) serveLocal(req *http.Request) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-x509-ca-cert")
+	header.Set("Content-Disposition", `attachment; filename="wx_channels_download_ca.crt"`)
+	return newResponse(req, http.StatusOK, e.ca.CertPEM, header)
+}
+
+func (e *MITMEngine) roundTrip(req *http.Request) *http.Response {
+	conn := &mitmConn{id: request_id.Add(1), req: req}
+	// 不需要解密的域名使用 HTTP 代理时也不调用 Handler
+	hooked := e.policy.Intercepted(req.URL.Hostname())
+	// 只有调用 Handler 并且不超过 maxBufferedBody 时才读取整个请求体，否则直接转发给服务器
+	body := req.Body
+	buffered := false
+	if hooked && req.ContentLength <= maxBufferedBody {
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxBufferedBody+1))
+		if err != nil {
+			req.Body.Close()
+			return newResponse(req, http.StatusBadRequest, []byte(err.Error()), nil)
+		}
+		if len(data) > maxBufferedBody {
+			// 没有 Content-Length 的请求读取之后才知道超过了大小
+			body = io.NopCloser(io.MultiReader(bytes.NewReader(data), req.Body))
+		} else {
+			req.Body.Close()
+			conn.req_body = data
+			buffered = true
+		}
+	}
+	if hooked && e.on_request != nil {
+		e.on_request(conn)
+	}
+	if conn.stopped != nil {
+		// 读完剩下的请求体，连接才可以继续读取下一个请求
+		req.Body.Close()
+		return conn.stopped
+	}
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	if buffered || conn.req_set {
+		out.Body = io.NopCloser(bytes.NewReader(conn.req_body))
+		out.ContentLength = int64(len(conn.req_body))
+		if len(conn.req_body) == 0 {
+			out.Body = http.NoBody
+		}
+	} else {
+		out.Body = body
+	}
+	upgrade := upgradeProtocol(req.Header)
+	removeHopHeaders(out.Header)
+	if upgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+	}
+	resp, err := e.Transport.RoundTrip(out)
+	if err != nil {
+		return newResponse(req, http.StatusBadGateway, []byte(err.Error()), nil)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// 响应体是和服务器之间的连接，不调用 OnResponse
+		upgrade = resp.Header.Get("Upgrade")
+		removeHopHeaders(resp.Header)
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgrade)
+		return resp
+	}
+	removeHopHeaders(resp.Header)
+	if !hooked || e.on_response == nil || streamed(resp) {
+		return resp
+	}
+	resp_body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return newResponse(req, http.StatusBadGateway, []byte(err.Error()), nil)
+	}
+	conn.resp = resp
+	conn.resp_body = resp_body
+	e.on_response(conn)
+	if conn.stopped != nil {
+		return conn.stopped
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(conn.resp_body))
+	// HEAD 和 204、304 的响应没有响应体，Content-Length 是服务器原来的值，Handler 没有修改时不能改成 0
+	if conn.resp_set || !noResponseBody(req.Method, resp.StatusCode) {
+		resp.ContentLength = int64(len(conn.resp_body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(conn.resp_body)))
+	}
+	return resp
+}
+
+func noResponseBody(method string, status int) bool {
+	return method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified || status < 200
+}
+
+// 请求升级的协议，如 websocket，没有时返回空字符串
+func upgradeProtocol(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// 服务器同意升级协议之后，代理只在客户端和服务器之间转发数据，不再解析 HTTP
+func switchProtocols(conn net.Conn, reader *bufio.Reader, resp *http.Response) {
+	server, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return
+	}
+	defer server.Close()
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(server, reader)
+		server.Close()
+		close(done)
+	}()
+	io.Copy(conn, server)
+	conn.Close()
+	<-done
+}
+
+func streamed(resp *http.Response) bool {
+	if resp.ContentLength > maxBufferedBody {
+		return true
+	}
+	content_type := strings.ToLower(resp.Header.Get("Content-Type"))
+	for _, t := range streamedContentTypes {
+		if strings.HasPrefix(content_type, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, name := range strings.Split(header.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			header.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// 客户端和代理之间始终使用 HTTP/1.1
+func writeResponse(w io.Writer, resp *http.Response) error {
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.TransferEncoding = nil
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	return resp.Write(w)
+}
+
+func newResponse(req *http.Request, status int, body []byte, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// 使用根证书签发站点证书，同一个域名只签发一次
+func (e *MITMEngine) certificate(host string) (*tls.Certificate, error) {
+	e.certs_mu.Lock()
+	defer e.certs_mu.Unlock()
+	if cert, ok := e.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	not_after := now.AddDate(1, 0, 0)
+	if not_after.After(e.ca.Cert.NotAfter) {
+		not_after = e.ca.Cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     not_after,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, e.ca.Cert, &e.leaf_key.PublicKey, e.ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("签发 %s 的证书失败，%v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, e.ca.Cert.Raw},
+		PrivateKey:  e.leaf_key,
+		Leaf:        leaf,
+	}
+	e.certs[host] = cert
+	return cert, nil
+}
+
+// CONNECT 之后客户端可能已经发送了部分 TLS 数据，需要先从 reader 中读取
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// 请求 ID，从 1 开始
+var request_id atomic.Uint64
+
+type mitmConn struct {
+	id        uint64
+	req       *http.Request
+	req_body  []byte
+	req_set   bool
+	resp      *http.Response
+	resp_body []byte
+	resp_set  bool
+	stopped   *http.Response
+}
+
+func (c *mitmConn) ID() uint64 {
+	return c.id
+}
+
+func (c *mitmConn) Request() *http.Request {
+	return c.req
+}
+
+func (c *mitmConn) RequestBody() []byte {
+	return c.req_body
+}
+
+func (c *mitmConn) SetRequestBody(body []byte) {
+	c.req_body = body
+	c.req_set = true
+}
+
+func (c *mitmConn) Response() *http.Response {
+	return c.resp
+}
+
+func (c *mitmConn) ResponseBody() []byte {
+	return c.resp_body
+}
+
+func (c *mitmConn) SetResponseBody(body []byte) {
+	c.resp_body = body
+	c.resp_set = true
+}
+
+func (c *mitmConn) StopRequest(status int, body []byte, header http.Header) {
+	c.stopped = newResponse(c.req, status, body, header.Clone())
+}
+
+var _ Engine = (*MITMEngine)(nil)
+var _ Conn = (*mitmConn)(nil)
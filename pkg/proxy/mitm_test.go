@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"wx_channel/pkg/certificate"
+)
+
+// 启动 MITM 代理，所有请求都转发到 server，返回代理地址和根证书
+func startTestMITM(t *testing.T, server *httptest.Server, policy *InterceptPolicy) (*MITMEngine, *certificate.CA) {
+	t.Helper()
+	ca, _, err := certificate.LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewMITMEngine("127.0.0.1:0", ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_addr := server.Listener.Addr().String()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, server_addr)
+	}
+	// httptest 的证书包含 example.com
+	transport.TLSClientConfig.ServerName = "example.com"
+	e.Transport = transport
+	e.SetInterceptPolicy(policy)
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Stop() })
+	return e, ca
+}
+
+// 通过 CONNECT 访问的客户端，信任 roots 中的证书
+func proxyClient(e *MITMEngine, roots *x509.CertPool) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: e.ListenAddr().String()}),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+}
+
+func TestMITMRoundTrip(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<head></head>%s %s %s", r.URL.Path, r.Header.Get("X-Test"), body)
+	}))
+	defer server.Close()
+	e, ca := startTestMITM(t, server, nil)
+	var ids []uint64
+	e.OnRequest(func(conn Conn) {
+		ids = append(ids, conn.ID())
+		req := conn.Request()
+		if req.URL.Path == "/stop" {
+			conn.StopRequest(http.StatusTeapot, []byte("stopped"), http.Header{"Content-Type": {"text/plain"}})
+			return
+		}
+		req.Header.Set("X-Test", "request")
+		conn.SetRequestBody(append(conn.RequestBody(), " modified"...))
+	})
+	e.OnResponse(func(conn Conn) {
+		ids = append(ids, conn.ID())
+		if conn.Request().URL.String() != "https://channels.weixin.qq.com/web/pages/feed" {
+			t.Errorf("url = %s", conn.Request().URL)
+		}
+		body := strings.Replace(string(conn.ResponseBody()), "<head>", "<head><script></script>", 1)
+		conn.SetResponseBody([]byte(body))
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := proxyClient(e, roots)
+
+	resp, err := client.Post("https://channels.weixin.qq.com/web/pages/feed", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "<head><script></script></head>/web/pages/feed request body modified"; string(data) != want {
+		t.Fatalf("body = %q, want %q", data, want)
+	}
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Fatalf("请求和响应的 ID 不一致 %v", ids)
+	}
+	// 站点证书由根证书签发
+	leaf := resp.TLS.PeerCertificates[0]
+	if leaf.Subject.CommonName != "channels.weixin.qq.com" || leaf.CheckSignatureFrom(ca.Cert) != nil {
+		t.Fatalf("证书 %s 不是根证书签发的", leaf.Subject)
+	}
+
+	resp, err = client.Get("https://channels.weixin.qq.com/stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || string(data) != "stopped" {
+		t.Fatalf("StopRequest 返回 %d %q", resp.StatusCode, data)
+	}
+}
+
+// 不需要解密的域名直接建立隧道，客户端看到的是服务器的证书
+func TestMITMTunnel(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnel")
+	}))
+	defer server.Close()
+	e, _ := startTestMITM(t, server, ParseInterceptPolicy("channels.weixin.qq.com"))
+	e.OnRequest(func(conn Conn) {
+		t.Errorf("隧道中的请求不应该调用 Handler，%s", conn.Request().URL)
+	})
+	client := proxyClient(e, server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "tunnel" || !resp.TLS.PeerCertificates[0].Equal(server.Certificate()) {
+		t.Fatalf("body = %q", data)
+	}
+}
+
+// WebSocket 升级之后双向转发数据
+func TestMITMUpgrade(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || upgradeProtocol(r.Header) == "" {
+			http.Error(w, "not upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString("echo " + line)
+		rw.Flush()
+	}))
+	defer server.Close()
+	e, ca := startTestMITM(t, server, nil)
+
+	conn, err := net.Dial("tcp", e.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT channels.weixin.qq.com:443 HTTP/1.1\r\nHost: channels.weixin.qq.com:443\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT 失败 %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tls_conn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "channels.weixin.qq.com"})
+	fmt.Fprintf(tls_conn, "GET /ws HTTP/1.1\r\nHost: channels.weixin.qq.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	tls_reader := bufio.NewReader(tls_conn)
+	resp, err = http.ReadResponse(tls_reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("升级失败 %d %v", resp.StatusCode, resp.Header)
+	}
+	io.WriteString(tls_conn, "ping\n")
+	line, err := tls_reader.ReadString('\n')
+	if err != nil || line != "echo ping\n" {
+		t.Fatalf("line = %q, %v", line, err)
+	}
+}
+
+// 超过 maxBufferedBody 的请求体不读入内存，直接转发给服务器
+func TestMITMLargeRequest(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d %v", n, err)
+	}))
+	defer server.Close()
+	e, ca := startTestMITM(t, server, nil)
+	var bodies [][]byte
+	e.OnRequest(func(conn Conn) {
+		bodies = append(bodies, conn.RequestBody())
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := proxyClient(e, roots)
+	const size = maxBufferedBody + 1024
+	for _, chunked := range []bool{false, true} {
+		var body io.Reader = io.LimitReader(zeroReader{}, size)
+		if chunked {
+			// 没有 Content-Length 时读到超过大小为止
+			body = struct{ io.Reader }{body}
+		}
+		req, err := http.NewRequest("POST", "https://channels.weixin.qq.com/upload", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !chunked {
+			req.ContentLength = size
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := fmt.Sprintf("%d <nil>", size); string(data) != want {
+			t.Fatalf("chunked = %v，服务器收到 %s，应为 %s", chunked, data, want)
+		}
+	}
+	if len(bodies) != 2 || bodies[0] != nil || bodies[1] != nil {
+		t.Fatalf("Handler 中的请求体应为 nil，%d", len(bodies))
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// HEAD 和 304 的响应经过 OnResponse 之后不修改 Content-Length
+func TestMITMNoBody(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/304" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "1234")
+		if r.Method != "HEAD" {
+			w.Write(make([]byte, 1234))
+		}
+	}))
+	defer server.Close()
+	e, ca := startTestMITM(t, server, nil)
+	e.OnResponse(func(conn Conn) {
+		if conn.Request().URL.Path == "/replace" {
+			conn.SetResponseBody(nil)
+		}
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := proxyClient(e, roots)
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		length       string
+	}{
+		{"HEAD", "/", http.StatusOK, "1234"},
+		// Go 的服务器不发送 304 的 Content-Length，代理也不能加上
+		{"GET", "/304", http.StatusNotModified, ""},
+		{"GET", "/", http.StatusOK, "1234"},
+		{"HEAD", "/replace", http.StatusOK, "0"},
+	} {
+		req, _ := http.NewRequest(tt.method, "https://channels.weixin.qq.com"+tt.path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Content-Length") != tt.length {
+			t.Errorf("%s %s 返回 %d，Content-Length = %q，应为 %s", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Content-Length"), tt.length)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/qtgolang/SunnyNet/SunnyNet"
+	"github.com/qtgolang/SunnyNet/src/Certificate"
+	sunnyhttp "github.com/qtgolang/SunnyNet/src/http"
+	"github.com/qtgolang/SunnyNet/src/public"
+
+	"wx_channel/pkg/certificate"
+)
+
+// 使用 SunnyNet 的代理，Windows 中可以通过驱动捕获指定进程的流量
+type SunnyEngine struct {
+	sunny       *SunnyNet.Sunny
+	port        int
+	ca          *certificate.CA
+	on_request  Handler
+	on_response Handler
+}
+
+func NewSunnyEngine(port int, ca *certificate.CA) *SunnyEngine {
+	return &SunnyEngine{sunny: SunnyNet.NewSunny(), port: port, ca: ca}
+}
+
+func (e *SunnyEngine) OnRequest(h Handler) {
+	e.on_request = h
+}
+
+func (e *SunnyEngine) OnResponse(h Handler) {
+	e.on_response = h
+}
+
+func (e *SunnyEngine) SetUpstream(u *Upstream) error {
+	if u == nil {
+		return nil
+	}
+	// SunnyNet 中 SOCKS5 代理的地址格式为 socket5://
+	proxy_url := *u.URL
+	if proxy_url.Scheme == "socks5" || proxy_url.Scheme == "socks5h" {
+		proxy_url.Scheme = "socket5"
+	}
+	e.sunny.SetGlobalProxy(proxy_url.String(), 30000)
+	if err := e.sunny.CompileProxyRegexp(strings.Join(u.Bypass, ";")); err != nil {
+		return fmt.Errorf("设置上游代理规则失败，%v", err)
+	}
+	return nil
+}
+
+func (e *SunnyEngine) SetInterceptPolicy(p *InterceptPolicy) error {
+	if p.All() {
+		return nil
+	}
+	// RulesAllow 为 false 时规则以外的连接强制走 TCP，直接转发，不解密也不调用回调
+	// 为 true 时相反，见 SunnyNet/SunnyNet.go 中 SetMustTcpRegexp 的注释
+	if err := e.sunny.SetMustTcpRegexp(mustTcpRules(p), false); err != nil {
+		return fmt.Errorf("设置解密规则失败，%v", err)
+	}
+	return nil
+}
+
+// SunnyNet 的规则使用分号分隔，只支持 * 通配符，.example.com 需要拆成 example.com 和 *.example.com
+func mustTcpRules(p *InterceptPolicy) string {
+	var rules []string
+	for _, host := range append(append([]string{}, p.Hosts...), probeHost) {
+		if strings.HasPrefix(host, ".") {
+			rules = append(rules, host[1:], "*"+host)
+			continue
+		}
+		rules = append(rules, host)
+	}
+	return strings.Join(rules, ";")
+}
+
+func (e *SunnyEngine) Start() error {
+	// 使用本机生成的根证书签发拦截站点的证书，不使用 SunnyNet 内置的公共证书
+	manager := Certificate.CreateCertificate()
+	if !Certificate.LoadX509Certificate(manager, "", string(e.ca.CertPEM), string(e.ca.KeyPEM)) {
+		return fmt.Errorf("加载根证书 %v 失败", e.ca.CertPath())
+	}
+	e.sunny.SetCert(manager)
+	e.sunny.SetPort(e.port)
+	e.sunny.SetGoCallback(e.callback, nil, nil, nil)
+	return e.sunny.Start().Error
+}
+
+func (e *SunnyEngine) Stop() error {
+	e.sunny.Close()
+	return nil
+}
+
+// 通过驱动捕获指定进程的流量，只支持 Windows
+func (e *SunnyEngine) CaptureProcess(names ...string) error {
+	if !e.sunny.OpenDrive(false) {
+		return errors.New("启动进程代理失败")
+	}
+	for _, name := range names {
+		e.sunny.ProcessAddName(name)
+	}
+	return nil
+}
+
+func (e *SunnyEngine) callback(conn SunnyNet.ConnHTTP) {
+	switch conn.Type() {
+	case public.HttpSendRequest:
+		if e.on_request != nil {
+			e.on_request(newSunnyConn(conn, false))
+		}
+	case public.HttpResponseOK:
+		if e.on_response != nil {
+			e.on_response(newSunnyConn(conn, true))
+		}
+	}
+}
+
+type sunnyConn struct {
+	conn SunnyNet.ConnHTTP
+	req  *http.Request
+	resp *http.Response
+}
+
+func newSunnyConn(conn SunnyNet.ConnHTTP, response bool) *sunnyConn {
+	u, err := url.Parse(conn.URL())
+	if err != nil {
+		u = &url.URL{}
+	}
+	// 和 SunnyNet 共用同一个 Header，修改后会发送给服务器
+	req := &http.Request{
+		Method: conn.Method(),
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header(conn.GetRequestHeader()),
+	}
+	c := &sunnyConn{conn: conn, req: req}
+	if response {
+		c.resp = &http.Response{
+			StatusCode: conn.GetResponseCode(),
+			Status:     http.StatusText(conn.GetResponseCode()),
+			Header:     http.Header(conn.GetResponseHeader()),
+			Request:    req,
+		}
+	}
+	return c
+}
+
+// SunnyNet 为每次请求分配的唯一 ID
+func (c *sunnyConn) ID() uint64 {
+	return uint64(c.conn.Theology())
+}
+
+func (c *sunnyConn) Request() *http.Request {
+	return c.req
+}
+
+func (c *sunnyConn) RequestBody() []byte {
+	return c.conn.GetRequestBody()
+}
+
+func (c *sunnyConn) SetRequestBody(body []byte) {
+	c.conn.SetRequestBody(body)
+}
+
+func (c *sunnyConn) Response() *http.Response {
+	return c.resp
+}
+
+func (c *sunnyConn) ResponseBody() []byte {
+	return c.conn.GetResponseBody()
+}
+
+func (c *sunnyConn) SetResponseBody(body []byte) {
+	c.conn.SetResponseBody(body)
+}
+
+func (c *sunnyConn) StopRequest(status int, body []byte, header http.Header) {
+	c.conn.StopRequest(status, body, sunnyhttp.Header(header))
+}
+
+// 保证实现了接口
+var _ Engine = (*SunnyEngine)(nil)
+var _ Conn = (*sunnyConn)(nil)
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// 按 SunnyNet 的方式把通配符规则转换为正则表达式，* 匹配任意字符
+func compileMustTcpRules(rules string) []*regexp.Regexp {
+	var list []*regexp.Regexp
+	for _, rule := range strings.Split(rules, ";") {
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(rule), `\*`, ".*")
+		list = append(list, regexp.MustCompile("(?i)^"+pattern+"$"))
+	}
+	return list
+}
+
+// 生成的规则和 MITMEngine 使用的 InterceptPolicy 解密的域名相同
+func TestMustTcpRules(t *testing.T) {
+	p := ParseInterceptPolicy("channels.weixin.qq.com; .video.qq.com, *.wx.qq.com")
+	rules := mustTcpRules(p)
+	if want := "channels.weixin.qq.com;video.qq.com;*.video.qq.com;*.wx.qq.com;sunny.io"; rules != want {
+		t.Fatalf("rules = %s，应为 %s", rules, want)
+	}
+	list := compileMustTcpRules(rules)
+	for _, host := range []string{
+		"channels.weixin.qq.com",
+		"Channels.Weixin.QQ.com",
+		"weixin.qq.com",
+		"video.qq.com",
+		"finder.video.qq.com",
+		"a.b.video.qq.com",
+		"xvideo.qq.com",
+		"res.wx.qq.com",
+		"wx.qq.com",
+		"sunny.io",
+		"example.com",
+	} {
+		matched := false
+		for _, re := range list {
+			if re.MatchString(host) {
+				matched = true
+				break
+			}
+		}
+		if matched != p.Intercepted(host) {
+			t.Errorf("%s: SunnyNet 规则 %v，InterceptPolicy %v", host, matched, p.Intercepted(host))
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"wx_channel/pkg/har"
+)
+
+// 录制的一个响应
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// 来源，用于输出
+	Source string
+}
+
+// 录制的请求和响应，实现了 http.RoundTripper，可以代替真实的服务器
+type Store struct {
+	mu sync.Mutex
+	// method + 完整地址
+	urls map[string]*Response
+	// method + 域名 + 路径，忽略查询参数
+	paths map[string]*Response
+	// 旧版本保存的 html/ 和 js/ 文件，只有路径，文件名为路径中的 / 替换为 _
+	captures []capture
+	// 没有找到录制内容的请求
+	missed []string
+}
+
+type capture struct {
+	name string
+	resp *Response
+}
+
+func NewStore() *Store {
+	return &Store{urls: make(map[string]*Response), paths: make(map[string]*Response)}
+}
+
+// 按文件类型加载，.har 文件，包含 .har 文件的目录，或者包含 html/ js/ 的目录
+func (s *Store) Load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.LoadHAR(path)
+	}
+	files, _ := filepath.Glob(filepath.Join(path, "*.har"))
+	for _, file := range files {
+		if err := s.LoadHAR(file); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"html", "js"} {
+		if err := s.LoadCaptures(filepath.Join(path, dir)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 同一个地址有多条记录时使用最后一条
+func (s *Store) LoadHAR(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file har.HAR
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s 不是有效的 HAR 文件，%v", path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range file.Log.Entries {
+		resp, err := fromEntry(entry)
+		if err != nil {
+			return fmt.Errorf("%s %s，%v", path, entry.Request.URL, err)
+		}
+		resp.Source = path
+		method := strings.ToUpper(entry.Request.Method)
+		s.urls[method+" "+entry.Request.URL] = resp
+		if key, ok := pathKey(method, entry.Request.URL); ok {
+			s.paths[key] = resp
+		}
+	}
+	return nil
+}
+
+func fromEntry(entry *har.Entry) (*Response, error) {
+	resp := &Response{Status: entry.Response.Status, Header: http.Header{}}
+	for _, h := range entry.Response.Headers {
+		// HAR 中的内容已经解压，隐藏的值不能原样返回
+		switch strings.ToLower(h.Name) {
+		case "content-encoding", "content-length", "transfer-encoding":
+			continue
+		}
+		if h.Value == har.Redacted {
+			continue
+		}
+		resp.Header.Add(h.Name, h.Value)
+	}
+	if resp.Header.Get("Content-Type") == "" && entry.Response.Content.MimeType != "" {
+		resp.Header.Set("Content-Type", entry.Response.Content.MimeType)
+	}
+	resp.Body = []byte(entry.Response.Content.Text)
+	if entry.Response.Content.Encoding == "base64" {
+		body, err := base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+func pathKey(method, raw string) (string, bool) {
+	i := strings.Index(raw, "://")
+	if i == -1 {
+		return "", false
+	}
+	rest := raw[i+3:]
+	if j := strings.IndexAny(rest, "?#"); j != -1 {
+		rest = rest[:j]
+	}
+	if !strings.Contains(rest, "/") {
+		rest += "/"
+	}
+	return method + " " + rest, true
+}
+
+// 旧版本保存的页面和脚本，文件名为 路径_查询参数_时间.html 或 路径_时间.js
+func (s *Store) LoadCaptures(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		content_type := ""
+		switch filepath.Ext(e.Name()) {
+		case ".html":
+			content_type = "text/html; charset=utf-8"
+		case ".js":
+			content_type = "application/javascript"
+		default:
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		header := http.Header{}
+		header.Set("Content-Type", content_type)
+		s.captures = append(s.captures, capture{
+			name: e.Name(),
+			resp: &Response{Status: http.StatusOK, Header: header, Body: body, Source: path},
+		})
+	}
+	// 文件名相同前缀时时间较晚的排在后面，查找时使用最后一个
+	sort.Slice(s.captures, func(i, j int) bool { return s.captures[i].name < s.captures[j].name })
+	return nil
+}
+
+// 记录的数量
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.urls) + len(s.captures)
+}
+
+// 依次按完整地址、忽略查询参数的地址、旧版本保存的文件查找
+func (s *Store) Find(req *http.Request) (*Response, bool) {
+	method := strings.ToUpper(req.Method)
+	raw := req.URL.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp, ok := s.urls[method+" "+raw]; ok {
+		return resp, true
+	}
+	// 回放时使用 HTTP 代理访问 http:// 地址也可以找到 https:// 的记录
+	if req.URL.Scheme == "http" {
+		if resp, ok := s.urls[method+" https"+strings.TrimPrefix(raw, "http")]; ok {
+			return resp, true
+		}
+	}
+	if key, ok := pathKey(method, raw); ok {
+		if resp, ok := s.paths[key]; ok {
+			return resp, true
+		}
+	}
+	if method != http.MethodGet {
+		return nil, false
+	}
+	name := strings.ReplaceAll(req.URL.Path, "/", "_")
+	if name == "" || name == "_" {
+		name = "_index"
+	}
+	for i := len(s.captures) - 1; i >= 0; i-- {
+		if strings.HasPrefix(s.captures[i].name, name+"_") {
+			return s.captures[i].resp, true
+		}
+	}
+	return nil, false
+}
+
+// 没有找到录制内容的请求
+func (s *Store) Missed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.missed...)
+}
+
+// 没有录制的请求返回 404
+func (s *Store) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	recorded, ok := s.Find(req)
+	if !ok {
+		s.mu.Lock()
+		s.missed = append(s.missed, req.Method+" "+req.URL.String())
+		s.mu.Unlock()
+		recorded = &Response{Status: http.StatusNotFound, Header: http.Header{}, Body: []byte("没有录制该请求")}
+		recorded.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	header := recorded.Header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(recorded.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
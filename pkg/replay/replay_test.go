@@ -0,0 +1,75 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"wx_channel/pkg/har"
+)
+
+// har.Recorder 写入的文件可以用于回放
+func TestLoadRecordedHAR(t *testing.T) {
+	r, err := har.NewRecorder(har.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte{0x00, 0xff, 0xfe, 0x80}
+	for i, tt := range []struct {
+		url          string
+		content_type string
+		body         []byte
+	}{
+		{"https://channels.weixin.qq.com/web/pages/feed?oid=1", "text/html", []byte("<head></head>")},
+		{"https://res.wx.qq.com/a.bin", "application/octet-stream", binary},
+	} {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		resp.Header.Set("Content-Type", tt.content_type)
+		resp.Header.Set("Content-Encoding", "gzip")
+		resp.Header.Set("Set-Cookie", "session=1")
+		r.Request(uint64(i+1), req, nil)
+		if err := r.Response(uint64(i+1), req, nil, resp, 100, tt.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore()
+	if err := s.LoadHAR(r.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("加载了 %d 条", s.Len())
+	}
+	for _, tt := range []struct {
+		url  string
+		body []byte
+	}{
+		{"https://channels.weixin.qq.com/web/pages/feed?oid=1", []byte("<head></head>")},
+		// 忽略查询参数
+		{"https://channels.weixin.qq.com/web/pages/feed?oid=2", []byte("<head></head>")},
+		{"https://res.wx.qq.com/a.bin", binary},
+	} {
+		resp, err := s.RoundTrip(httptest.NewRequest("GET", tt.url, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(data, tt.body) {
+			t.Fatalf("%s 返回 %d %q", tt.url, resp.StatusCode, data)
+		}
+		// 内容已经解压，隐藏的值不能返回
+		if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Set-Cookie") != "" {
+			t.Fatalf("%s 的响应头 %v", tt.url, resp.Header)
+		}
+	}
+	if missed := s.Missed(); len(missed) != 0 {
+		t.Fatalf("missed = %v", missed)
+	}
+}
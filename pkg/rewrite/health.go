@@ -0,0 +1,178 @@
+package rewrite
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 同一个脚本的一个版本，用原始内容的 SHA-256 区分
+type Bundle struct {
+	// 适用的必须匹配的规则名称，用于区分不同的脚本
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	SHA256    string    `json:"sha256"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Matched   []string  `json:"matched"`
+	Missing   []string  `json:"missing,omitempty"`
+}
+
+// 一条必须匹配的规则在本次运行中的情况
+type RuleStatus struct {
+	Name        string    `json:"name"`
+	Matched     int       `json:"matched"`
+	Missed      int       `json:"missed"`
+	LastURL     string    `json:"last_url,omitempty"`
+	LastMissed  time.Time `json:"last_missed,omitempty"`
+	LastMatched time.Time `json:"last_matched,omitempty"`
+}
+
+type HealthReport struct {
+	OK bool `json:"ok"`
+	// 最近一次没有匹配的规则
+	Missing []string     `json:"missing"`
+	Rules   []RuleStatus `json:"rules"`
+	// 每个脚本最近的版本
+	Bundles []*Bundle `json:"bundles"`
+}
+
+// 记录脚本的指纹和规则的匹配情况，用于发现视频号前端更新后失效的规则
+type Health struct {
+	path    string
+	mu      sync.Mutex
+	rules   map[string]*RuleStatus
+	bundles []*Bundle
+}
+
+// 一次记录的结果，用于输出提示
+type Observation struct {
+	Bundle Bundle
+	// 第一次看到这个版本
+	New bool
+	// 该脚本之前有其他版本，说明前端已经更新
+	Changed bool
+}
+
+// path 为保存脚本指纹历史的文件
+func OpenHealth(path string) (*Health, error) {
+	h := &Health{path: path, rules: make(map[string]*RuleStatus)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &h.bundles); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// 记录一次 Apply 的结果，original 为修改前的内容
+// 只对有必须匹配规则的 JS 记录指纹，HTML 页面每次内容都不同
+func (h *Health) Observe(url, content_type string, original []byte, results []Result) (*Observation, error) {
+	var names, matched, missing []string
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		if !r.Rule.Required {
+			continue
+		}
+		status, ok := h.rules[r.Rule.Name]
+		if !ok {
+			status = &RuleStatus{Name: r.Rule.Name}
+			h.rules[r.Rule.Name] = status
+		}
+		status.LastURL = url
+		names = append(names, r.Rule.Name)
+		if r.Replaced > 0 {
+			status.Matched++
+			status.LastMatched = now
+			matched = append(matched, r.Rule.Name)
+		} else {
+			status.Missed++
+			status.LastMissed = now
+			missing = append(missing, r.Rule.Name)
+		}
+	}
+	if len(names) == 0 || !strings.Contains(strings.ToLower(content_type), "javascript") {
+		return nil, nil
+	}
+	sum := sha256.Sum256(original)
+	fingerprint := hex.EncodeToString(sum[:])
+	name := strings.Join(names, "+")
+	var previous bool
+	for _, b := range h.bundles {
+		if b.Name != name {
+			continue
+		}
+		if b.SHA256 == fingerprint {
+			b.LastSeen = now
+			b.URL = url
+			return &Observation{Bundle: *b}, nil
+		}
+		previous = true
+	}
+	b := &Bundle{Name: name, URL: url, SHA256: fingerprint, FirstSeen: now, LastSeen: now, Matched: matched, Missing: missing}
+	h.bundles = append(h.bundles, b)
+	return &Observation{Bundle: *b, New: true, Changed: previous}, h.save()
+}
+
+func (h *Health) save() error {
+	data, err := json.MarshalIndent(h.bundles, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// 所有脚本版本，按第一次出现的时间排序
+func (h *Health) History() []*Bundle {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]*Bundle, 0, len(h.bundles))
+	for _, b := range h.bundles {
+		copied := *b
+		list = append(list, &copied)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].FirstSeen.Before(list[j].FirstSeen) })
+	return list
+}
+
+// 必须匹配的规则最近一次没有匹配时视为异常
+func (h *Health) Report() HealthReport {
+	report := HealthReport{OK: true, Missing: []string{}, Rules: []RuleStatus{}, Bundles: []*Bundle{}}
+	latest := make(map[string]*Bundle)
+	for _, b := range h.History() {
+		if last, ok := latest[b.Name]; !ok || b.LastSeen.After(last.LastSeen) {
+			latest[b.Name] = b
+		}
+	}
+	h.mu.Lock()
+	for _, status := range h.rules {
+		report.Rules = append(report.Rules, *status)
+		if status.LastMissed.After(status.LastMatched) {
+			report.OK = false
+			report.Missing = append(report.Missing, status.Name)
+		}
+	}
+	h.mu.Unlock()
+	sort.Slice(report.Rules, func(i, j int) bool { return report.Rules[i].Name < report.Rules[j].Name })
+	sort.Strings(report.Missing)
+	for _, b := range latest {
+		report.Bundles = append(report.Bundles, b)
+	}
+	sort.Slice(report.Bundles, func(i, j int) bool { return report.Bundles[i].Name < report.Bundles[j].Name })
+	return report
+}
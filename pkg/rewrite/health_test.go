@@ -0,0 +1,89 @@
+package rewrite
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundles.json")
+	h, err := OpenHealth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Parse([]byte(`[
+		{"name": "store", "match": "store", "replace": "", "required": true},
+		{"name": "cut", "match": "cut", "replace": "", "required": true},
+		{"name": "optional", "match": "optional", "replace": ""}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Set{rules: rules}
+	observe := func(url, content_type, body string) *Observation {
+		t.Helper()
+		_, results := s.Apply("res.wx.qq.com", "/", content_type, []byte(body), nil)
+		o, err := h.Observe(url, content_type, []byte(body), results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	o := observe("https://res.wx.qq.com/index.js?v=1", "application/javascript", "store cut")
+	first := o.Bundle.SHA256
+	if !o.New || o.Changed || o.Bundle.Name != "store+cut" || len(o.Bundle.Matched) != 2 {
+		t.Fatalf("第一次记录 %+v", o)
+	}
+	// 内容相同时不是新版本
+	if o := observe("https://res.wx.qq.com/index.js?v=2", "application/javascript", "store cut"); o.New || o.Changed || o.Bundle.URL != "https://res.wx.qq.com/index.js?v=2" {
+		t.Fatalf("相同内容 %+v", o)
+	}
+	if report := h.Report(); !report.OK || len(report.Missing) != 0 || len(report.Rules) != 2 || len(report.Bundles) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	// HTML 页面只记录规则的匹配情况
+	if o := observe("https://channels.weixin.qq.com/web/pages/feed", "text/html", "store cut"); o != nil {
+		t.Fatalf("HTML 不应该记录指纹，%+v", o)
+	}
+
+	// 前端更新之后规则没有匹配
+	o = observe("https://res.wx.qq.com/index.js?v=3", "application/javascript", "store")
+	if !o.New || !o.Changed || len(o.Bundle.Missing) != 1 || o.Bundle.Missing[0] != "cut" {
+		t.Fatalf("脚本更新 %+v", o)
+	}
+	report := h.Report()
+	if report.OK || len(report.Missing) != 1 || report.Missing[0] != "cut" {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(report.Bundles) != 1 || report.Bundles[0].SHA256 != o.Bundle.SHA256 {
+		t.Fatalf("report 中应该只有最新的版本，%+v", report.Bundles)
+	}
+	missed := map[string]int{"store": 0, "cut": 1}
+	for _, status := range report.Rules {
+		if status.Matched+status.Missed != 4 || status.Missed != missed[status.Name] {
+			t.Errorf("rule = %+v", status)
+		}
+	}
+	// 之后又匹配了
+	observe("https://res.wx.qq.com/index.js?v=4", "application/javascript", "store cut cut")
+	if report := h.Report(); !report.OK {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 重新打开时读取之前的指纹，规则的匹配情况只在本次运行中有效
+	h, err = OpenHealth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := h.History()
+	if len(history) != 3 || history[0].SHA256 != first {
+		t.Fatalf("history = %+v", history)
+	}
+	if report := h.Report(); !report.OK || len(report.Rules) != 0 || len(report.Bundles) != 1 {
+		t.Fatalf("重新打开之后 report = %+v", report)
+	}
+	if o := observe("https://res.wx.qq.com/index.js?v=1", "application/javascript", "store cut"); o.New {
+		t.Fatalf("之前记录的版本 %+v", o)
+	}
+}
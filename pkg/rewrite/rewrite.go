@@ -0,0 +1,293 @@
+package rewrite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内置的规则，没有指定规则文件时使用
+//
+//go:embed rules.json
+var DefaultRules []byte
+
+// 一条替换规则，host path content_type 都符合时在响应内容中用 replace 替换 match
+type Rule struct {
+	Name string `json:"name"`
+	// 为空时匹配所有域名，.example.com 匹配 example.com 和它的子域名
+	Host string `json:"host,omitempty"`
+	// 匹配 URL 路径的正则表达式，为空时匹配所有路径
+	Path string `json:"path,omitempty"`
+	// Content-Type 前缀，如 text/html，为空时匹配所有类型
+	ContentType string `json:"content_type,omitempty"`
+	// 正则表达式
+	Match string `json:"match"`
+	// 可以使用 $1 引用分组，{{name}} 引用 Apply 时传入的变量
+	Replace Text `json:"replace"`
+	// 只替换第一处
+	Once bool `json:"once,omitempty"`
+	// 必须匹配，没有匹配时说明页面已经更新，规则需要修改
+	Required bool `json:"required,omitempty"`
+	// 匹配成功时输出的信息
+	Message string `json:"message,omitempty"`
+
+	path  *regexp.Regexp
+	match *regexp.Regexp
+}
+
+// 字符串，或者按行分隔的字符串数组，方便书写多行的 JS
+type Text string
+
+func (t *Text) UnmarshalJSON(data []byte) error {
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err == nil {
+		*t = Text(strings.Join(lines, "\n"))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("replace 应为字符串或字符串数组")
+	}
+	*t = Text(s)
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if r.Match == "" {
+		return fmt.Errorf("规则 %s 缺少 match", r.Name)
+	}
+	var err error
+	if r.match, err = regexp.Compile(r.Match); err != nil {
+		return fmt.Errorf("规则 %s 的 match 格式错误，%v", r.Name, err)
+	}
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("规则 %s 的 path 格式错误，%v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) applicable(host, path, content_type string) bool {
+	host = strings.ToLower(host)
+	rule_host := strings.ToLower(r.Host)
+	switch {
+	case rule_host == "":
+	case strings.HasPrefix(rule_host, "."):
+		if host != rule_host[1:] && !strings.HasSuffix(host, rule_host) {
+			return false
+		}
+	case host != rule_host:
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(path) {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(content_type), strings.ToLower(r.ContentType))
+}
+
+// 替换所有匹配，Once 时只替换第一处，变量在分组展开之后替换，变量的值中的 $ 不会被当作分组
+func (r *Rule) replace(body []byte, vars map[string]string) ([]byte, int) {
+	n := -1
+	if r.Once {
+		n = 1
+	}
+	matches := r.match.FindAllSubmatchIndex(body, n)
+	if len(matches) == 0 {
+		return body, 0
+	}
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		buf.Write(body[last:m[0]])
+		expanded := r.match.Expand(nil, []byte(r.Replace), body, m)
+		buf.WriteString(expandVars(string(expanded), vars))
+		last = m[1]
+	}
+	buf.Write(body[last:])
+	return buf.Bytes(), len(matches)
+}
+
+func expandVars(s string, vars map[string]string) string {
+	if len(vars) == 0 || !strings.Contains(s, "{{") {
+		return s
+	}
+	pairs := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		pairs = append(pairs, "{{"+k+"}}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// 一条规则对一次响应的处理结果
+type Result struct {
+	Rule     *Rule
+	Replaced int
+}
+
+// 规则集合，指定了文件时可以在文件修改后重新加载
+type Set struct {
+	path    string
+	mu      sync.RWMutex
+	rules   []*Rule
+	hash    string
+	modtime time.Time
+	done    chan struct{}
+}
+
+func Parse(data []byte) ([]*Rule, error) {
+	var rules []*Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("规则格式错误，%v", err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// path 为空时使用内置的规则，规则文件会完全替换内置的规则
+func Load(path string) (*Set, error) {
+	s := &Set{path: path}
+	if path == "" {
+		rules, err := Parse(DefaultRules)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = rules
+		s.hash = hashRules(DefaultRules)
+		return s, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 文件修改时间变化时重新读取，返回是否重新加载了
+func (s *Set) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modtime)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	rules, err := Parse(data)
+	s.mu.Lock()
+	// 格式错误时继续使用之前的规则，文件再次修改后才重试
+	s.modtime = info.ModTime()
+	if err == nil {
+		s.rules = rules
+		s.hash = hashRules(data)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("%s %v", s.path, err)
+	}
+	return true, nil
+}
+
+// 每隔 interval 检查一次规则文件，重新加载后调用 callback，加载失败时 err 不为 nil
+func (s *Set) Watch(interval time.Duration, callback func(count int, err error)) {
+	if s.path == "" || s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// 同样的错误只通知一次，如文件被删除
+		last_err := ""
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			reloaded, err := s.reload()
+			if err != nil {
+				if err.Error() != last_err && callback != nil {
+					callback(len(s.Rules()), err)
+				}
+				last_err = err.Error()
+				continue
+			}
+			last_err = ""
+			if reloaded && callback != nil {
+				callback(len(s.Rules()), nil)
+			}
+		}
+	}()
+}
+
+func (s *Set) Close() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
+
+func hashRules(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 当前规则内容的 SHA-256，规则修改后会变化
+func (s *Set) Hash() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hash
+}
+
+// 规则文件路径，使用内置规则时为空
+func (s *Set) Path() string {
+	return s.path
+}
+
+func (s *Set) Rules() []*Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules
+}
+
+// 是否有规则需要修改该响应，没有时不需要读取和解码响应体
+func (s *Set) Applicable(host, path, content_type string) bool {
+	for _, r := range s.Rules() {
+		if r.applicable(host, path, content_type) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按顺序执行所有符合条件的规则，返回替换后的内容和每条规则的结果
+func (s *Set) Apply(host, path, content_type string, body []byte, vars map[string]string) ([]byte, []Result) {
+	var results []Result
+	for _, r := range s.Rules() {
+		if !r.applicable(host, path, content_type) {
+			continue
+		}
+		var n int
+		body, n = r.replace(body, vars)
+		results = append(results, Result{Rule: r, Replaced: n})
+	}
+	return body, results
+}
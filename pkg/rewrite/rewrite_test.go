@@ -0,0 +1,193 @@
+package rewrite
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReplace(t *testing.T) {
+	rules, err := Parse([]byte(`[
+		{"name": "string", "match": "a", "replace": "b"},
+		{"name": "lines", "match": "a", "replace": ["b", "c"]},
+		{"name": "empty", "match": "a", "replace": []}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []Text{"b", "b\nc", ""} {
+		if rules[i].Replace != want {
+			t.Errorf("%s: replace = %q，应为 %q", rules[i].Name, rules[i].Replace, want)
+		}
+	}
+	for _, data := range []string{
+		`[{"name": "number", "match": "a", "replace": 1}]`,
+		`[{"name": "no match", "replace": "b"}]`,
+		`[{"name": "bad match", "match": "(", "replace": "b"}]`,
+		`[{"name": "bad path", "path": "(", "match": "a", "replace": "b"}]`,
+		`{}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s 应该返回错误", data)
+		}
+	}
+	if _, err := Parse(DefaultRules); err != nil {
+		t.Fatalf("内置规则格式错误，%v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	rules, err := Parse([]byte(`[
+		{"name": "all", "match": "a(\\d)", "replace": "b$1"},
+		{"name": "once", "match": "x", "replace": "y", "once": true},
+		{"name": "vars", "match": "<head>", "replace": ["<head>", "<script>{{token}} {{missing}}</script>"]},
+		{"name": "required", "match": "not found", "replace": "", "required": true}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Set{rules: rules}
+	// 变量的值中的 $1 不能被当作分组
+	body, results := s.Apply("channels.weixin.qq.com", "/", "text/html", []byte("a1 a2 x x <head>"), map[string]string{"token": "$1${2}"})
+	if want := "b1 b2 y x <head>\n<script>$1${2} {{missing}}</script>"; string(body) != want {
+		t.Fatalf("body = %q，应为 %q", body, want)
+	}
+	want := map[string]int{"all": 2, "once": 1, "vars": 1, "required": 0}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v", results)
+	}
+	for _, r := range results {
+		if r.Replaced != want[r.Rule.Name] {
+			t.Errorf("%s 替换了 %d 处，应为 %d", r.Rule.Name, r.Replaced, want[r.Rule.Name])
+		}
+	}
+	if r := results[3]; !r.Rule.Required || r.Replaced != 0 {
+		t.Errorf("required 规则没有匹配时应返回 0，%+v", r)
+	}
+}
+
+func TestApplicable(t *testing.T) {
+	rules, err := Parse([]byte(`[
+		{"name": "page", "host": "channels.weixin.qq.com", "path": "^/web/pages/", "content_type": "text/html", "match": "a", "replace": "b"},
+		{"name": "script", "host": ".Wx.QQ.com", "content_type": "application/javascript", "match": "a", "replace": "b"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Set{rules: rules}
+	for _, tt := range []struct {
+		host, path, content_type string
+		want                     string
+	}{
+		{"channels.weixin.qq.com", "/web/pages/feed", "text/html; charset=utf-8", "page"},
+		{"Channels.Weixin.QQ.com", "/web/pages/feed", "TEXT/HTML", "page"},
+		{"channels.weixin.qq.com", "/web/pages/feed", "text/plain", ""},
+		{"channels.weixin.qq.com", "/cgi-bin/", "text/html", ""},
+		{"weixin.qq.com", "/web/pages/feed", "text/html", ""},
+		{"res.wx.qq.com", "/a.js", "application/javascript", "script"},
+		{"wx.qq.com", "/a.js", "application/javascript", "script"},
+		{"xwx.qq.com", "/a.js", "application/javascript", ""},
+		{"res.wx.qq.com", "/a.js", "application/json", ""},
+	} {
+		_, results := s.Apply(tt.host, tt.path, tt.content_type, []byte("a"), nil)
+		got := ""
+		if len(results) == 1 {
+			got = results[0].Rule.Name
+		}
+		if got != tt.want || s.Applicable(tt.host, tt.path, tt.content_type) != (tt.want != "") {
+			t.Errorf("%s %s %s 匹配了 %q，应为 %q", tt.host, tt.path, tt.content_type, got, tt.want)
+		}
+	}
+}
+
+func writeRules(t *testing.T, path string, data string, modtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	now := time.Now().Add(-time.Hour)
+	writeRules(t, path, `[{"name": "a", "match": "a", "replace": "b"}]`, now)
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := s.Hash()
+	if len(s.Rules()) != 1 || hash == "" || s.Path() != path {
+		t.Fatalf("rules = %v", s.Rules())
+	}
+	// 修改时间没有变化时不重新读取
+	writeRules(t, path, `[]`, now)
+	if reloaded, err := s.reload(); reloaded || err != nil || len(s.Rules()) != 1 {
+		t.Fatalf("修改时间相同时重新加载了，%v", err)
+	}
+
+	writeRules(t, path, `[{"name": "a", "match": "a", "replace": "b"}, {"name": "b", "match": "b", "replace": "c"}]`, now.Add(time.Minute))
+	if reloaded, err := s.reload(); !reloaded || err != nil || len(s.Rules()) != 2 || s.Hash() == hash {
+		t.Fatalf("没有重新加载，%v", err)
+	}
+	hash = s.Hash()
+
+	// 格式错误时保留之前的规则，同一个文件不会重复报错
+	writeRules(t, path, `[{"name": "bad"`, now.Add(2*time.Minute))
+	if _, err := s.reload(); err == nil || !strings.Contains(err.Error(), path) {
+		t.Fatalf("格式错误时应返回错误，%v", err)
+	}
+	if len(s.Rules()) != 2 || s.Hash() != hash {
+		t.Fatal("格式错误时规则被替换了")
+	}
+	if reloaded, err := s.reload(); reloaded || err != nil {
+		t.Fatalf("文件没有修改时重新加载了，%v", err)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("文件不存在时 err = %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	now := time.Now().Add(-time.Hour)
+	writeRules(t, path, `[{"name": "a", "match": "a", "replace": "b"}]`, now)
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type event struct {
+		count int
+		err   error
+	}
+	events := make(chan event, 10)
+	s.Watch(10*time.Millisecond, func(count int, err error) {
+		events <- event{count, err}
+	})
+	defer s.Close()
+	wait := func() event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("没有重新加载")
+		}
+		return event{}
+	}
+
+	writeRules(t, path, `[{"name": "bad"`, now.Add(time.Minute))
+	if e := wait(); e.err == nil || e.count != 1 {
+		t.Fatalf("格式错误时 %+v", e)
+	}
+	writeRules(t, path, `[{"name": "a", "match": "a", "replace": "b"}, {"name": "b", "match": "b", "replace": "c"}]`, now.Add(2*time.Minute))
+	if e := wait(); e.err != nil || e.count != 2 {
+		t.Fatalf("重新加载之后 %+v", e)
+	}
+}
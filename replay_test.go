@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wx_channel/pkg/certificate"
+	"wx_channel/pkg/download"
+	"wx_channel/pkg/replay"
+	"wx_channel/pkg/rewrite"
+)
+
+// 使用录制的 HAR 回放，检查替换规则、注入的脚本和用户信息，并且不写入正常运行时的目录
+func TestReplay(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	output := t.TempDir()
+	prev_rules, prev_health, prev_downloader, prev_dir, prev_profiles := rules, health, downloader, profiles_dir, userProfiles
+	t.Cleanup(func() {
+		rules, health, downloader, profiles_dir, userProfiles = prev_rules, prev_health, prev_downloader, prev_dir, prev_profiles
+	})
+	var err error
+	if rules, err = rewrite.Load(""); err != nil {
+		t.Fatal(err)
+	}
+	if health, err = rewrite.OpenHealth(filepath.Join(output, "bundles.json")); err != nil {
+		t.Fatal(err)
+	}
+	if downloader, err = download.NewManager(output, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	profiles_dir = filepath.Join(output, "profiles")
+	userProfiles = make(map[string]*UserProfile)
+
+	store := replay.NewStore()
+	if err := store.Load(filepath.Join("testdata", "replay.har")); err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := certificate.LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp_dir, err := isolateReplay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp_dir)
+	replay_engine, err := startReplay(store, "127.0.0.1:0", ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay_engine.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: replay_engine.ListenAddr().String()}),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	fetch := func(method, u string, body string, header http.Header) string {
+		t.Helper()
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s 状态码 %d，%s", method, u, resp.StatusCode, data)
+		}
+		return string(data)
+	}
+
+	page := fetch("GET", "https://channels.weixin.qq.com/web/pages/feed?oid=1&nid=2", "", nil)
+	if !strings.Contains(page, "<head>\n<script>window.__wx_channels_api_token__ = \""+api_token+"\";\n") {
+		t.Fatalf("页面中没有注入脚本，%.200s", page)
+	}
+	if !strings.Contains(page, `index.publish.js?t=`+cacheVersion()+`"`) {
+		t.Fatal("页面中的脚本地址没有加上版本")
+	}
+	script := fetch("GET", "https://res.wx.qq.com/t/wx_fed/finder/web/web-finder/res/js/index.publish.js", "", nil)
+	for _, want := range []string{
+		`import"./vue.runtime.js?t=` + cacheVersion() + `"`,
+		"window.__wx_channels_store__.buffers.push(h);",
+		`if(f.cmd==="CUT"){`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("脚本中没有 %s，%s", want, script)
+		}
+	}
+	fetch("POST", "https://channels.weixin.qq.com/cgi-bin/mmfinderassistant-bin/finder/profile", `{"scene":7}`, nil)
+	profiles_mu.Lock()
+	profile := userProfiles["v2_replay@finder"]
+	profiles_mu.Unlock()
+	if profile == nil || profile.Nickname != "回放测试" {
+		t.Fatalf("没有提取到用户信息，%v", userProfiles)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp_dir, "profiles", "*.json")); len(files) != 1 {
+		t.Fatalf("临时目录中的用户信息 %v", files)
+	}
+
+	// 内部接口返回的是回放时的脚本指纹
+	header := http.Header{}
+	header.Set(api_token_header, api_token)
+	header.Set("Origin", "https://channels.weixin.qq.com")
+	var report rewrite.HealthReport
+	if err := json.Unmarshal([]byte(fetch("GET", "https://channels.weixin.qq.com/__wx_channels_api/health", "", header)), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || len(report.Bundles) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	fetch("POST", "https://channels.weixin.qq.com/__wx_channels_api/download", `{"id":"1","title":"回放","url":"https://finder.video.qq.com/251/20302/stodownload?encfilekey=a"}`, header)
+	if _, err := os.Stat(filepath.Join(tmp_dir, "downloads", "queue.json")); err != nil {
+		t.Fatal("下载队列没有保存到临时目录")
+	}
+	if missed := store.Missed(); len(missed) != 0 {
+		t.Fatalf("没有录制的请求 %v", missed)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmp_dir, "bundles.json")); err != nil {
+		t.Fatal("脚本指纹没有保存到临时目录")
+	}
+	for _, name := range []string{"bundles.json", "profiles", "queue.json"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err == nil {
+			t.Fatalf("回放时写入了 %s", name)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/download"
+)
+
+// 关注列表，文件中每行一个用户名，# 开头的行是注释
+// 页面中出现关注的用户时，自动下载还没有下载过的视频
+type Watchlist struct {
+	path     string
+	mu       sync.Mutex
+	users    map[string]bool
+	mod_time time.Time
+	// 每个用户本次运行新加入下载的视频标题
+	archived map[string][]string
+}
+
+var watchlist *Watchlist
+
+func loadWatchlist(path string) (*Watchlist, error) {
+	w := &Watchlist{path: path, archived: make(map[string][]string)}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// 文件修改后重新读取
+func (w *Watchlist) reload() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(w.mod_time) && w.users != nil {
+		return nil
+	}
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		users[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	w.users = users
+	w.mod_time = info.ModTime()
+	return nil
+}
+
+func (w *Watchlist) Contains(profile *UserProfile) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.reload(); err != nil {
+		slog.Error("读取关注列表失败", "path", w.path, "error", err)
+	}
+	return w.users[profile.Username] || (profile.ID != "" && w.users[profile.ID])
+}
+
+// 将关注用户还没有下载过的视频加入下载队列，调用时不能持有 profiles_mu
+func (w *Watchlist) Archive(profile *UserProfile) {
+	// 其他请求可能同时在修改用户信息，使用副本
+	profiles_mu.Lock()
+	profile = profile.clone()
+	profiles_mu.Unlock()
+	if !w.Contains(profile) {
+		return
+	}
+	var titles []string
+	for _, video := range profile.Videos {
+		if video.URL == "" {
+			continue
+		}
+		media := videoToMedia(video)
+		media.Nickname = profile.Nickname
+		_, err := downloader.Add(media, false)
+		if err == download.ErrDownloaded || err == download.ErrQueued {
+			continue
+		}
+		if err != nil {
+			slog.Error("[关注] 添加下载失败", "title", video.Title, "error", err)
+			continue
+		}
+		titles = append(titles, video.Title)
+	}
+	if len(titles) == 0 {
+		return
+	}
+	name := profileName(profile)
+	w.mu.Lock()
+	w.archived[name] = append(w.archived[name], titles...)
+	w.mu.Unlock()
+	slog.Info("[关注] 新加入下载", "user", name, "count", len(titles), "titles", titles)
+	slog.Info("[关注] 本次运行新加入下载的视频", "users", w.counts())
+}
+
+// 每个关注用户新加入下载的视频数量
+func (w *Watchlist) counts() map[string]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	counts := make(map[string]int, len(w.archived))
+	for name, titles := range w.archived {
+		counts[name] = len(titles)
+	}
+	return counts
+}
+
+// 本次运行中每个关注用户新下载的视频数量
+func (w *Watchlist) Summary() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.archived) == 0 {
+		return "[关注] 本次没有新的视频"
+	}
+	var names []string
+	for name := range w.archived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("[关注] 本次新加入下载的视频")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %s: %d 个", name, len(w.archived[name]))
+	}
+	return b.String()
+}
+
+func profileName(profile *UserProfile) string {
+	if profile.Nickname != "" {
+		return profile.Nickname
+	}
+	if profile.Username != "" {
+		return profile.Username
+	}
+	return profile.ID
+}
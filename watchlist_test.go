@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeWatchlist(t *testing.T, path string, data string, modtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchlistContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchlist.txt")
+	now := time.Now().Add(-time.Hour)
+	writeWatchlist(t, path, "# 关注的用户\nv2_a@finder\n\n  user_id  \n", now)
+	w, err := loadWatchlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		profile UserProfile
+		want    bool
+	}{
+		{UserProfile{Username: "v2_a@finder"}, true},
+		{UserProfile{Username: "v2_b@finder", ID: "user_id"}, true},
+		{UserProfile{Username: "v2_b@finder"}, false},
+		{UserProfile{Username: "# 关注的用户"}, false},
+		{UserProfile{}, false},
+	} {
+		if got := w.Contains(&tt.profile); got != tt.want {
+			t.Errorf("Contains(%+v) = %v，应为 %v", tt.profile, got, tt.want)
+		}
+	}
+	// 文件修改后重新读取
+	writeWatchlist(t, path, "v2_b@finder\n", now.Add(time.Minute))
+	if w.Contains(&UserProfile{Username: "v2_a@finder"}) || !w.Contains(&UserProfile{Username: "v2_b@finder"}) {
+		t.Fatal("关注列表修改后没有重新读取")
+	}
+	if _, err := loadWatchlist(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("文件不存在时应返回错误")
+	}
+}
+
+func TestWatchlistArchive(t *testing.T) {
+	dir := useTestProfiles(t)
+	path := filepath.Join(dir, "watchlist.txt")
+	writeWatchlist(t, path, "v2_watch@finder\n", time.Now())
+	w, err := loadWatchlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Summary(); got != "[关注] 本次没有新的视频" {
+		t.Fatalf("Summary() = %q", got)
+	}
+	videos := []VideoInfo{
+		{ID: "1", Title: "已下载", URL: "https://finder.video.qq.com/stodownload?encfilekey=1"},
+		{ID: "2", Title: "已在队列中", URL: "https://finder.video.qq.com/stodownload?encfilekey=2"},
+		{ID: "3", Title: "新视频", URL: "https://finder.video.qq.com/stodownload?encfilekey=3"},
+		{ID: "4", Title: "没有地址"},
+	}
+	markDownloaded(t, videos[0])
+	if _, err := downloader.Add(videoToMedia(videos[1]), false); err != nil {
+		t.Fatal(err)
+	}
+	profile := &UserProfile{Username: "v2_watch@finder", Nickname: "关注", Videos: videos}
+	w.Archive(profile)
+	jobs := downloader.Queue.Jobs()
+	if len(jobs) != 2 || jobs[1].Media.ID != "3" || jobs[1].Media.Nickname != "关注" {
+		t.Fatalf("jobs = %+v", jobs)
+	}
+	if counts := w.counts(); len(counts) != 1 || counts["关注"] != 1 {
+		t.Fatalf("counts = %v", counts)
+	}
+	// 再次出现时视频都已经在队列中
+	w.Archive(profile)
+	if counts := w.counts(); counts["关注"] != 1 || len(downloader.Queue.Jobs()) != 2 {
+		t.Fatalf("counts = %v", counts)
+	}
+	// 不在关注列表中的用户
+	w.Archive(&UserProfile{Username: "v2_other@finder", Videos: []VideoInfo{{ID: "5", URL: "https://finder.video.qq.com/stodownload?encfilekey=5"}}})
+	if len(downloader.Queue.Jobs()) != 2 {
+		t.Fatal("没有关注的用户的视频加入了下载队列")
+	}
+
+	// 没有昵称时使用用户名
+	w.Archive(&UserProfile{Username: "v2_watch@finder", Videos: []VideoInfo{{ID: "6", Title: "另一个", URL: "https://finder.video.qq.com/stodownload?encfilekey=6"}}})
+	want := []string{"[关注] 本次新加入下载的视频", "  v2_watch@finder: 1 个", "  关注: 1 个"}
+	if got := w.Summary(); got != strings.Join(want, "\n") {
+		t.Fatalf("Summary() = %q", got)
+	}
+}